@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gdamore/tcell"
-	sh "github.com/jeffwilliams/spacehoarder"
 	dt "github.com/jeffwilliams/spacehoarder/dirtree"
 )
 
-func ApplyAll(screen tcell.Screen, t *dt.Dirtree, root *dt.Node, m *sync.Mutex, ops chan dt.OpData, onAdd WhenNodeAdded) {
+// ApplyAll applies the operations from ops to the tree t, and shows the progress from prog in the
+// status bar. Once ctx is done the remaining operations are discarded, since the build was superseded
+// by a newer one. The operations on the nodes for which fenced returns true are discarded too, since
+// they are being built by a newer build.
+func ApplyAll(ctx context.Context, screen tcell.Screen, t *dt.Dirtree, root *dt.Node, m *sync.Mutex, ops chan dt.OpData, prog chan dt.Progress, fenced func(n *dt.Node) bool, onAdd WhenNodeAdded) {
 
 	ch := make(chan struct{})
 
@@ -21,14 +29,35 @@ func ApplyAll(screen tcell.Screen, t *dt.Dirtree, root *dt.Node, m *sync.Mutex,
 		}
 	}()
 
-	ctx := dt.NewApplyContext(root)
+	applyCtx := dt.NewApplyContext(root)
+	applyCtx.Fenced = fenced
+
+	// The build closes prog before ops, so the last progress is shown before the total.
+	for ops != nil {
+		var op dt.OpData
+		var ok bool
+		select {
+		case p, ok := <-prog:
+			if !ok {
+				prog = nil
+			} else if ctx.Err() == nil {
+				buildStatus.SetStatus("%s", p)
+			}
+			continue
+		case op, ok = <-ops:
+			if !ok {
+				ops = nil
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			continue
+		}
 
-	for op := range ops {
 		m.Lock()
-		added := t.ApplyCtx(ctx, op)
+		added := t.ApplyCtx(applyCtx, op)
 		if added != nil {
 			updateHiddenFlag(added)
-			buildStatus.SetStatus("Processing %s", added.Info.Path)
 		}
 		if added == t.Root {
 			// Root node is always expanded
@@ -41,9 +70,14 @@ func ApplyAll(screen tcell.Screen, t *dt.Dirtree, root *dt.Node, m *sync.Mutex,
 		default:
 		}
 	}
+	close(ch)
+
+	if ctx.Err() != nil {
+		return
+	}
 
 	if t.Root != nil {
-		buildStatus.SetStatus("Total %s", sh.FancySize(t.Root.Info.Size))
+		buildStatus.SetStatus("Total %s", t.Root.Info.FormatSize(t.SizeMode))
 	} else {
 		buildStatus.SetStatus(".")
 	}
@@ -51,7 +85,7 @@ func ApplyAll(screen tcell.Screen, t *dt.Dirtree, root *dt.Node, m *sync.Mutex,
 	screen.PostEvent(&de)
 }
 
-func drop(c chan string) {
+func drop(c chan dt.Progress) {
 	for _ = range c {
 
 	}
@@ -59,13 +93,334 @@ func drop(c chan string) {
 
 type WhenNodeAdded func(n *dt.Node)
 
+// baseBuildOpts are the options used for every build started by the ui.
+// Both sizes are always computed so that the size shown can be switched without rebuilding.
+var baseBuildOpts = dt.BuildOpts{
+	OneFs:     true,
+	Workers:   dt.DefaultBuildOpts.Workers,
+	SizeMode:  dt.SizeModeBoth,
+	HardLinks: dt.DefaultBuildOpts.HardLinks,
+}
+
+// newBuildOpts returns a copy of baseBuildOpts that optionally includes files.
+func newBuildOpts(includeFiles bool) *dt.BuildOpts {
+	opts := baseBuildOpts
+	opts.IncludeFiles = includeFiles
+	return &opts
+}
+
+// roots are the directories given on the command line. If there are several, builds of the
+// path "" build all of them under a synthetic root.
+var roots []string
+
+// startOps starts building rootPath from the filesystem fs, or from the local filesystem if fs is nil.
+func startOps(ctx context.Context, fs dt.Filesystem, rootPath string, opts *dt.BuildOpts) (ops chan dt.OpData, prog chan dt.Progress) {
+	switch {
+	case fs != nil:
+		return dt.BuildFsContext(ctx, fs, rootPath, opts)
+	case rootPath == "" && len(roots) > 1:
+		return dt.BuildMultiContext(ctx, roots, opts)
+	}
+	return dt.BuildContext(ctx, rootPath, opts)
+}
+
+// mountOpts returns the options that select the mounts to read by type, or nil if the flags select none.
+func mountOpts() *dt.MountOpts {
+	if len(optFsAllow) == 0 && len(optFsDeny) == 0 {
+		return nil
+	}
+	return &dt.MountOpts{Allow: optFsAllow, Deny: optFsDeny}
+}
+
 // build sets up pipelines used to add nodes to the
 // dirtree that we display in the ui.
 func build(screen tcell.Screen, dtw *DirtreeWidget, rootNode *dt.Node, rootPath string, opts *dt.BuildOpts, onAdd WhenNodeAdded) {
 	if opts == nil {
 		opts = dt.DefaultBuildOpts
 	}
-	ops, prog := dt.Build(rootPath, opts)
-	go ApplyAll(screen, dtw.dt, rootNode, &dtw.Mutex, ops, onAdd)
+	if rootNode != nil {
+		// The patterns and the links are relative to the root of the tree, not to the directory read again.
+		o := *opts
+		o.Root = buildRoot(rootNode)
+		opts = &o
+	}
+	ctx, fenced, done := dtw.startBuild(rootNode)
+	ops, prog := startOps(ctx, dtw.fs, rootPath, opts)
+	go func() {
+		ApplyAll(ctx, screen, dtw.dt, rootNode, &dtw.Mutex, ops, prog, fenced, onAdd)
+		if ctx.Err() == nil {
+			dtw.watchNode(rootNode)
+		}
+		done()
+	}()
+}
+
+// buildRoot returns the path of the root that the node n was built from.
+func buildRoot(n *dt.Node) string {
+	for n.Parent != nil && n.Parent.Info.Type != dt.PathTypeMulti {
+		n = n.Parent
+	}
+	return n.Info.Path
+}
+
+// saveSnapshot builds the tree of rootPath without the ui and saves it to the file name.
+// If fs is nil the local filesystem is read. If prev is not nil, the build is incremental.
+func saveSnapshot(fs dt.Filesystem, rootPath, name string, sizeMode dt.SizeMode, prev *dt.Dirtree) error {
+	opts := newBuildOpts(false)
+	opts.Previous = prev
+	ops, prog := startOps(context.Background(), fs, rootPath, opts)
 	go drop(prog)
+
+	tree := dt.New()
+	tree.SizeMode = sizeMode
+	tree.ApplyAll(ops)
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := tree.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if rootPath == "" {
+		rootPath = strings.Join(roots, ", ")
+	}
+	if tree.Root != nil {
+		fmt.Printf("Saved %s of %s to %s\n", tree.Root.Info.FormatSize(sizeMode), rootPath, name)
+	}
+	return nil
+}
+
+// loadSnapshot loads the tree saved in the file name.
+func loadSnapshot(name string) (*dt.Dirtree, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tree, err := dt.Load(f)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s failed: %v", name, err)
+	}
+	return tree, nil
+}
+
+// snapshotRoots returns the directories that the tree t was built from.
+func snapshotRoots(t *dt.Dirtree) []string {
+	if t.Root == nil {
+		return nil
+	}
+	if t.Root.Info.Type != dt.PathTypeMulti {
+		return []string{t.Root.Info.Path}
+	}
+
+	var paths []string
+	for _, c := range t.Root.Children {
+		paths = append(paths, c.Info.Path)
+	}
+	return paths
+}
+
+// samePaths returns true if a and b hold the same paths, in any order.
+func samePaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	count := make(map[string]int)
+	for _, p := range a {
+		count[filepath.Clean(p)]++
+	}
+	for _, p := range b {
+		if count[filepath.Clean(p)] == 0 {
+			return false
+		}
+		count[filepath.Clean(p)]--
+	}
+	return true
+}
+
+// setTree replaces the tree shown by the widget with t. Only the root of t is expanded.
+func (w *DirtreeWidget) setTree(t *dt.Dirtree) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	t.SetSortChildren(true)
+	t.SetSizeMode(w.dt.SizeMode)
+	if t.Root != nil {
+		setTreeNodeFlags(t.Root, TreeNodeFlagExpanded)
+		t.Root.Walk(func(n *dt.Node, depth int) (cont, skipChildren bool) {
+			updateHiddenFlag(n)
+			return true, false
+		}, 0)
+	}
+
+	w.dt = t
+	w.selectedNode = nil
+	w.toDelete = nil
+
+	if w.watcher != nil && t.Root != nil {
+		w.watcher.AddTree(t.Root)
+		watchStatus.SetStatus("Watching with %s", w.watcher.Mode())
+	}
+}
+
+// watchNode watches the directories under n, or the whole tree if n is nil, once they are built.
+func (w *DirtreeWidget) watchNode(n *dt.Node) {
+	if w.watcher == nil {
+		return
+	}
+
+	w.Mutex.Lock()
+	if n == nil {
+		n = w.dt.Root
+	}
+	if n != nil {
+		w.watcher.AddTree(n)
+	}
+	w.Mutex.Unlock()
+
+	watchStatus.SetStatus("Watching with %s", w.watcher.Mode())
+}
+
+// isBuilding returns true if n is under the root of a running build.
+func (w *DirtreeWidget) isBuilding(n *dt.Node) bool {
+	w.buildsMutex.Lock()
+	defer w.buildsMutex.Unlock()
+
+	for _, b := range w.builds {
+		if b.root == nil || isUnder(n, b.root) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch applies the updates from the watcher to the tree.
+func (w *DirtreeWidget) watch() {
+	for u := range w.watcher.Updates {
+		w.applyUpdate(u)
+	}
+}
+
+// updateDir reads the directory path again, and updates the tree with its contents.
+func (w *DirtreeWidget) updateDir(path string) {
+	w.Mutex.Lock()
+	root := w.dt.BuildRoot(path)
+	w.Mutex.Unlock()
+
+	if root != nil {
+		w.applyUpdate(dt.ReadDirUpdate(dt.OsFilesystem{}, root.Info.Path, path, newBuildOpts(false)))
+	}
+}
+
+// applyUpdate applies the update u to the tree, and builds the directories that were added.
+// Updates for directories that are being built are dropped, since the build reads them anyway.
+func (w *DirtreeWidget) applyUpdate(u *dt.DirUpdate) {
+	w.Mutex.Lock()
+	n := w.dt.Find(u.Path)
+	if n == nil || w.isBuilding(n) {
+		w.Mutex.Unlock()
+		return
+	}
+
+	filesShown := treeNodeFlags(n).IsSet(TreeNodeFlagFilesShown)
+	var dirs []*dt.Node
+	for _, c := range w.dt.ApplyUpdate(u) {
+		updateHiddenFlag(c)
+		if c.Info.Type == dt.PathTypeDir || c.Info.Type == dt.PathTypeSymlinkDir {
+			if filesShown {
+				SetTreeNodeFlag(c, TreeNodeFlagFilesShown)
+			}
+			dirs = append(dirs, c)
+		}
+	}
+	if w.selectedNode != nil && !isUnder(w.selectedNode, w.dt.Root) {
+		w.selectedNode = n
+	}
+	if w.toDelete != nil && !isUnder(w.toDelete, w.dt.Root) {
+		w.toDelete = nil
+	}
+	w.Mutex.Unlock()
+
+	for _, c := range dirs {
+		build(w.screen, w, c, c.Info.Path, newBuildOpts(filesShown), nil)
+	}
+
+	de := DirtreeDrawEvent(time.Now())
+	w.screen.PostEvent(&de)
+}
+
+// runningBuild is a build that is adding nodes under root.
+type runningBuild struct {
+	root   *dt.Node
+	cancel context.CancelFunc
+	// fences are the roots of the builds started after this one under its root. This build leaves the
+	// nodes under them alone, even once those builds are finished.
+	fences []*dt.Node
+}
+
+// isUnder returns true if n is ancestor or one of its descendants.
+func isUnder(n, ancestor *dt.Node) bool {
+	for ; n != nil; n = n.Parent {
+		if n == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// startBuild cancels the running builds that add nodes under rootNode, since they are
+// superseded by a new build of rootNode, and fences rootNode off from the running builds of its
+// ancestors. It returns the context for the new build, the function that tells which nodes it must
+// leave alone, and a function to call when the new build is finished. If rootNode is nil all builds
+// are cancelled.
+func (w *DirtreeWidget) startBuild(rootNode *dt.Node) (ctx context.Context, fenced func(n *dt.Node) bool, done func()) {
+	w.buildsMutex.Lock()
+	defer w.buildsMutex.Unlock()
+
+	for _, b := range w.builds {
+		if rootNode == nil || isUnder(b.root, rootNode) {
+			b.cancel()
+		} else if b.root == nil || isUnder(rootNode, b.root) {
+			b.fences = append(b.fences, rootNode)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &runningBuild{root: rootNode, cancel: cancel}
+	w.builds = append(w.builds, b)
+
+	fenced = func(n *dt.Node) bool {
+		w.buildsMutex.Lock()
+		defer w.buildsMutex.Unlock()
+
+		for _, f := range b.fences {
+			if isUnder(n, f) {
+				return true
+			}
+		}
+		return false
+	}
+
+	done = func() {
+		w.buildsMutex.Lock()
+		defer w.buildsMutex.Unlock()
+
+		for i, v := range w.builds {
+			if v == b {
+				w.builds = append(w.builds[:i], w.builds[i+1:]...)
+				break
+			}
+		}
+		cancel()
+	}
+
+	return ctx, fenced, done
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+	dt "github.com/jeffwilliams/spacehoarder/dirtree"
+)
+
+const diffUsage = "sph -diff [-diffcount count] old.snap new.snap"
+
+// runDiff implements the -diff flag, which compares two snapshots of the same directory given in args
+// and prints the count paths that grew the most.
+func runDiff(args []string, count int) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s", diffUsage)
+	}
+
+	old, err := loadSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+	new, err := loadSnapshot(args[1])
+	if err != nil {
+		return err
+	}
+
+	d := dt.Diff(old, new)
+	if d == nil {
+		fmt.Printf("Both snapshots are empty\n")
+		return nil
+	}
+
+	var oldSize, newSize int64
+	if d.Old != nil {
+		oldSize = d.Old.Info.Size
+	}
+	if d.New != nil {
+		newSize = d.New.Info.Size
+	}
+	name := d.Path
+	if name == "" {
+		// The synthetic root of several directories.
+		name = d.Basename
+	}
+	fmt.Printf("%s: %s -> %s (%s)\n", name, sh.FancySize(oldSize), sh.FancySize(newSize), sh.FancySizeDelta(d.SizeDelta))
+
+	for _, g := range d.TopGrowers(count) {
+		fmt.Printf("%10s  %-7s  %s\n", sh.FancySizeDelta(g.OwnSizeDelta()), g.Kind, g.Path)
+	}
+	return nil
+}
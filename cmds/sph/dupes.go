@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/views"
+	sh "github.com/jeffwilliams/spacehoarder"
+	dt "github.com/jeffwilliams/spacehoarder/dirtree"
+)
+
+var dupesHelpMsg = "<del>: remove file  d/<esc>: back to tree"
+
+// findDuplicates looks for duplicate files under the selected directory in the background, and
+// shows them once they are found. Only one search runs at a time, until it's stopped with stopDuplicates.
+func (w *DirtreeWidget) findDuplicates() {
+	if w.fs != nil {
+		w.errStatus.SetStatus("Finding duplicates is not supported here")
+		return
+	}
+
+	w.Mutex.Lock()
+	if w.stopDupes != nil {
+		w.Mutex.Unlock()
+		return
+	}
+	n := w.selectedNode
+	if n != nil && n.Info.Type != dt.PathTypeDir && n.Info.Type != dt.PathTypeSymlinkDir {
+		n = n.Parent
+	}
+	if n == nil {
+		w.Mutex.Unlock()
+		return
+	}
+	path := n.Info.Path
+	opts := newBuildOpts(true)
+	opts.Root = buildRoot(n)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.stopDupes = cancel
+	w.Mutex.Unlock()
+
+	go func() {
+		defer w.endDuplicates(cancel)
+
+		buildStatus.SetStatus("Finding duplicates in %s (<esc> to stop)", path)
+		ops, prog := dt.BuildContext(ctx, path, opts)
+		go drop(prog)
+		tree := dt.New()
+		tree.ApplyAll(ops)
+		if ctx.Err() != nil {
+			return
+		}
+
+		groups, errs, err := dt.FindDuplicatesContext(ctx, tree, dt.DefaultDupOpts)
+		if err != nil {
+			return
+		}
+		app.PostFunc(func() {
+			w.showDuplicates(path, groups, errs)
+		})
+	}()
+}
+
+// stopDuplicates stops the search for duplicates, if one is running.
+func (w *DirtreeWidget) stopDuplicates() {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.stopDupes != nil {
+		w.stopDupes()
+		buildStatus.SetStatus("Stopped finding duplicates")
+	}
+}
+
+// endDuplicates is called when the search for duplicates that is stopped by cancel ends.
+func (w *DirtreeWidget) endDuplicates(cancel context.CancelFunc) {
+	cancel()
+
+	w.Mutex.Lock()
+	w.stopDupes = nil
+	w.Mutex.Unlock()
+}
+
+// showDuplicates replaces the tree with the list of groups of duplicates found under path.
+func (w *DirtreeWidget) showDuplicates(path string, groups []*dt.DuplicateGroup, errs []*dt.ScanError) {
+	if len(errs) > 0 {
+		w.errStatus.SetStatus("%v (and %d more errors)", errs[0], len(errs)-1)
+	}
+	if len(groups) == 0 {
+		buildStatus.SetStatus("No duplicates in %s", path)
+		return
+	}
+
+	var reclaimable int64
+	for _, g := range groups {
+		reclaimable += g.Reclaimable()
+	}
+	buildStatus.SetStatus("%d groups of duplicates in %s, %s reclaimable", len(groups), path, sh.FancySize(reclaimable))
+
+	panel.SetContent(newDupesWidget(w, groups))
+	help.SetText(dupesHelpMsg)
+}
+
+// dupesRow is a row of a DupesWidget: either the header of a group, or one of its files.
+type dupesRow struct {
+	group *dt.DuplicateGroup
+	// file is the index of the file in the group, or -1 for the header.
+	file int
+}
+
+// DupesWidget lists groups of duplicate files, and lets files be removed from them.
+type DupesWidget struct {
+	views.WidgetWatchers
+	scrollList
+	// dtw is the tree the duplicates are in. It's updated when files are removed.
+	dtw      *DirtreeWidget
+	groups   []*dt.DuplicateGroup
+	rows     []dupesRow
+	toDelete *dt.Node
+}
+
+func newDupesWidget(dtw *DirtreeWidget, groups []*dt.DuplicateGroup) *DupesWidget {
+	d := &DupesWidget{dtw: dtw, groups: groups}
+	d.layout()
+	return d
+}
+
+// layout lists the rows for the groups.
+func (d *DupesWidget) layout() {
+	d.rows = d.rows[:0]
+	for _, g := range d.groups {
+		d.rows = append(d.rows, dupesRow{group: g, file: -1})
+		for i := range g.Files {
+			d.rows = append(d.rows, dupesRow{group: g, file: i})
+		}
+	}
+	d.clamp(len(d.rows))
+}
+
+func (d *DupesWidget) Draw() {
+	if d.view == nil {
+		return
+	}
+	d.view.Clear()
+
+	_, maxY := d.view.Size()
+	d.scroll(maxY)
+
+	for y := 0; y < maxY && d.top+y < len(d.rows); y++ {
+		r := d.rows[d.top+y]
+		ctx := TcellPrintContext{View: d.view, Style: tcell.StyleDefault, Y: y}
+		if d.top+y == d.selected {
+			ctx.Style = ctx.Style.Background(tcell.ColorBlue)
+		}
+
+		if r.file < 0 {
+			ctx.Style = ctx.Style.Foreground(tcell.Color(172))
+			ViewPrint(&ctx, "%d x %s, %s reclaimable", len(r.group.Files), sh.FancySize(r.group.Size), sh.FancySize(r.group.Reclaimable()))
+		} else {
+			ViewPrint(&ctx, "  %s", r.group.Files[r.file].Info.Path)
+		}
+	}
+}
+
+// close goes back to the tree.
+func (d *DupesWidget) close() {
+	deleteStatus.SetStatus("")
+	panel.SetContent(d.dtw)
+	help.SetText(keysHelpMsg)
+}
+
+// remove deletes the file n, and removes it from its group. Groups that are left with a single file are removed.
+func (d *DupesWidget) remove(n *dt.Node) {
+	if err := os.Remove(n.Info.Path); err != nil {
+		deleteStatus.SetStatus("Deleting failed: %v", err)
+		return
+	}
+	deleteStatus.SetStatus("")
+
+	groups := d.groups[:0]
+	for _, g := range d.groups {
+		for i, f := range g.Files {
+			if f == n {
+				g.Files = append(g.Files[:i], g.Files[i+1:]...)
+				break
+			}
+		}
+		if len(g.Files) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	d.groups = groups
+	d.layout()
+
+	d.dtw.updateDir(filepath.Dir(n.Info.Path))
+}
+
+func (d *DupesWidget) HandleEvent(ev tcell.Event) bool {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		staged := false
+		switch ev.Key() {
+		case tcell.KeyDown, tcell.KeyUp, tcell.KeyHome, tcell.KeyEnd:
+			d.move(ev.Key(), len(d.rows))
+		case tcell.KeyEscape:
+			d.close()
+		case tcell.KeyDelete:
+			if len(d.rows) > 0 {
+				if r := d.rows[d.selected]; r.file >= 0 {
+					d.toDelete = r.group.Files[r.file]
+					deleteStatus.SetStatus("Type 'y' to confirm delete")
+					staged = true
+				}
+			}
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'Q', 'q':
+				app.Quit()
+			case 'D', 'd':
+				d.close()
+			case 'Y', 'y':
+				if d.toDelete != nil {
+					d.remove(d.toDelete)
+					d.toDelete = nil
+					if len(d.groups) == 0 {
+						buildStatus.SetStatus("No duplicates left")
+						d.close()
+					}
+				}
+			default:
+				return false
+			}
+		default:
+			return false
+		}
+
+		// The user did not confirm the delete.
+		if !staged && d.toDelete != nil {
+			d.toDelete = nil
+			deleteStatus.SetStatus("")
+		}
+		return true
+
+	case *DirtreeDrawEvent:
+		return true
+	}
+
+	return false
+}
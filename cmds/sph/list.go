@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/views"
+)
+
+// scrollList holds the view and the selected row of a widget that lists rows, one per line.
+type scrollList struct {
+	view     views.View
+	selected int
+	// top is the first row shown.
+	top int
+}
+
+// clamp keeps the selected row within a list of n rows.
+func (l *scrollList) clamp(n int) {
+	if l.selected >= n {
+		l.selected = n - 1
+	}
+	if l.selected < 0 {
+		l.selected = 0
+	}
+}
+
+// scroll moves the rows shown in a space of lines lines so that the selected row is shown.
+func (l *scrollList) scroll(lines int) {
+	if l.selected < l.top {
+		l.top = l.selected
+	}
+	if l.selected >= l.top+lines {
+		l.top = l.selected - lines + 1
+	}
+	if l.top < 0 {
+		l.top = 0
+	}
+}
+
+// move changes the selected row of a list of n rows for the key k. It returns false if k doesn't move the selection.
+func (l *scrollList) move(k tcell.Key, n int) bool {
+	switch k {
+	case tcell.KeyDown:
+		if l.selected < n-1 {
+			l.selected++
+		}
+	case tcell.KeyUp:
+		if l.selected > 0 {
+			l.selected--
+		}
+	case tcell.KeyHome:
+		l.selected = 0
+	case tcell.KeyEnd:
+		l.selected = n - 1
+		l.clamp(n)
+	default:
+		return false
+	}
+	return true
+}
+
+func (l *scrollList) Resize() {
+}
+
+func (l *scrollList) SetView(view views.View) {
+	l.view = view
+}
+
+func (l *scrollList) Size() (int, int) {
+	// Take up the available space, like DirtreeWidget.
+	return 0, 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell"
+	sh "github.com/jeffwilliams/spacehoarder"
+	dt "github.com/jeffwilliams/spacehoarder/dirtree"
+)
+
+// overlayKind is a list shown over the tree that describes the selected directory.
+type overlayKind uint8
+
+const (
+	overlayNone overlayKind = iota
+	// overlayTypes lists the top file types.
+	overlayTypes
+	// overlayOwners lists the top users and groups that own files.
+	overlayOwners
+)
+
+// typesShown is the number of types listed in the overlay.
+const typesShown = 10
+
+// ownersShown is the number of users, and of groups, listed in the overlay.
+const ownersShown = 5
+
+// overlayWidth is the width of the overlay.
+const overlayWidth = 40
+
+// The names of the user and group ids, read from sh.PasswdFile and sh.GroupFile.
+var userNames, groupNames map[uint32]string
+
+// toggleOverlay shows the overlay k, or hides it if it's already shown.
+func (w *DirtreeWidget) toggleOverlay(k overlayKind) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.overlay == k {
+		w.overlay = overlayNone
+		return
+	}
+	w.overlay = k
+
+	if k == overlayTypes && baseBuildOpts.FileTypes == dt.FileTypesNone {
+		w.errStatus.SetStatus("Files are not grouped by type; use -types")
+	}
+	if k == overlayOwners && !baseBuildOpts.Owners {
+		w.errStatus.SetStatus("Owners are not recorded; use -owners")
+	}
+}
+
+// drawOverlay draws the overlay in the top right corner of the view, for the selected directory. The mutex must be held.
+func (w *DirtreeWidget) drawOverlay() {
+	n := w.selectedNode
+	if n != nil && n.Info.Type != dt.PathTypeDir && n.Info.Type != dt.PathTypeSymlinkDir && n.Parent != nil {
+		n = n.Parent
+	}
+	if n == nil {
+		return
+	}
+
+	mode := w.dt.SizeMode
+	if mode == dt.SizeModeBoth || mode == dt.SizeModeStaleness {
+		mode = dt.SizeModeApparent
+	}
+
+	var lines []string
+	switch w.overlay {
+	case overlayTypes:
+		lines = typesLines(n, mode)
+	case overlayOwners:
+		lines = ownersLines(n, mode)
+	}
+
+	maxX, _ := w.view.Size()
+	x := maxX - overlayWidth
+	if x < 0 {
+		x = 0
+	}
+	ctx := TcellPrintContext{View: w.view, Style: tcell.StyleDefault.Background(tcell.ColorDarkSlateGray)}
+	for y, l := range lines {
+		ctx.X, ctx.Y = x, y
+		ViewPrint(&ctx, " %-*.*s ", overlayWidth-2, overlayWidth-2, l)
+	}
+}
+
+// overlayLine formats a line of the overlay for name, which holds the part pct of the total.
+func overlayLine(name string, t *dt.TypeTotals, mode dt.SizeMode, total int64) string {
+	size := sh.FancySize(t.SizeIn(mode))
+	if mode == dt.SizeModeEntries {
+		size = fmt.Sprintf("%d", t.Files)
+	}
+	pct := 0.0
+	if total > 0 {
+		pct = float64(t.SizeIn(mode)) * 100 / float64(total)
+	}
+	return fmt.Sprintf("%-16.16s %10s %5.1f%%", name, size, pct)
+}
+
+// typesLines returns the lines of the overlay that lists the top file types under n.
+func typesLines(n *dt.Node, mode dt.SizeMode) []string {
+	types := n.TopTypes(0, mode)
+	var total int64
+	for _, t := range types {
+		total += t.SizeIn(mode)
+	}
+
+	lines := []string{fmt.Sprintf("Top types in %s", n.Info.Basename)}
+	for i, t := range types {
+		if i == typesShown {
+			lines = append(lines, fmt.Sprintf("%d more types", len(types)-i))
+			break
+		}
+		lines = append(lines, overlayLine(t.Type, &t.TypeTotals, mode, total))
+	}
+	if len(types) == 0 {
+		lines = append(lines, "No files")
+	}
+	return lines
+}
+
+// ownersLines returns the lines of the overlay that lists the top users and groups that own the files under n.
+func ownersLines(n *dt.Node, mode dt.SizeMode) []string {
+	owners := func(title string, owners []dt.OwnerCount, names map[uint32]string) []string {
+		var total int64
+		for _, o := range owners {
+			total += o.SizeIn(mode)
+		}
+
+		lines := []string{fmt.Sprintf("Top %s in %s", title, n.Info.Basename)}
+		for i, o := range owners {
+			if i == ownersShown {
+				lines = append(lines, fmt.Sprintf("%d more %s", len(owners)-i, title))
+				break
+			}
+			lines = append(lines, overlayLine(sh.IdName(names, o.Id), &o.TypeTotals, mode, total))
+		}
+		if len(owners) == 0 {
+			lines = append(lines, "No files")
+		}
+		return lines
+	}
+
+	lines := owners("users", n.TopUsers(0, mode), userNames)
+	return append(lines, owners("groups", n.TopGroups(0, mode), groupNames)...)
+}
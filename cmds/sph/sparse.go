@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/views"
+	sh "github.com/jeffwilliams/spacehoarder"
+	dt "github.com/jeffwilliams/spacehoarder/dirtree"
+)
+
+var sparseHelpMsg = "h: only large holes  p: only preallocated  s/<esc>: back to tree"
+
+// showSparse replaces the tree with the list of files under the selected directory whose allocated size
+// differs a lot from their apparent size.
+func (w *DirtreeWidget) showSparse() {
+	if baseBuildOpts.Sparse == nil {
+		w.errStatus.SetStatus("Sparse files are not looked for; use -sparse")
+		return
+	}
+
+	w.Mutex.Lock()
+	n := w.selectedNode
+	if n != nil && n.Info.Type != dt.PathTypeDir && n.Info.Type != dt.PathTypeSymlinkDir && n.Parent != nil {
+		n = n.Parent
+	}
+	var files []*dt.SparseFile
+	if n != nil {
+		files = n.SparseFiles()
+	}
+	w.Mutex.Unlock()
+
+	if len(files) == 0 {
+		if n != nil {
+			buildStatus.SetStatus("No sparse or preallocated files in %s", n.Info.Path)
+		}
+		return
+	}
+
+	s := &SparseWidget{dtw: w, path: n.Info.Path, all: files}
+	s.setFilter(false, 0)
+	panel.SetContent(s)
+	help.SetText(sparseHelpMsg)
+}
+
+// SparseWidget lists files whose allocated size differs a lot from their apparent size, optionally only
+// those of one kind.
+type SparseWidget struct {
+	views.WidgetWatchers
+	scrollList
+	// dtw is the tree shown again when the list is closed.
+	dtw *DirtreeWidget
+	// path is the directory the files are under.
+	path string
+	all  []*dt.SparseFile
+	// files are the files in all that pass the filter.
+	files []*dt.SparseFile
+	// If filtered is true, only the files of the kind filter are listed.
+	filtered bool
+	filter   dt.SparseKind
+}
+
+// setFilter lists only the files of the kind k if filtered is true, or all files otherwise.
+func (s *SparseWidget) setFilter(filtered bool, k dt.SparseKind) {
+	s.filtered, s.filter = filtered, k
+
+	s.files = s.files[:0]
+	var diff int64
+	for _, f := range s.all {
+		if !filtered || f.Kind == k {
+			s.files = append(s.files, f)
+			diff += f.Diff()
+		}
+	}
+	s.clamp(len(s.files))
+
+	what := "sparse or preallocated files"
+	if filtered && k == dt.SparseHoles {
+		what = "files with large holes"
+	} else if filtered {
+		what = "preallocated files"
+	}
+	buildStatus.SetStatus("%d %s in %s, differing by %s", len(s.files), what, s.path, sh.FancySize(diff))
+}
+
+// toggleFilter lists only the files of the kind k, or all files if they are already filtered by k.
+func (s *SparseWidget) toggleFilter(k dt.SparseKind) {
+	s.setFilter(!s.filtered || s.filter != k, k)
+}
+
+func (s *SparseWidget) Draw() {
+	if s.view == nil {
+		return
+	}
+	s.view.Clear()
+
+	ctx := TcellPrintContext{View: s.view, Style: tcell.StyleDefault.Foreground(tcell.Color(172))}
+	ViewPrint(&ctx, "%-12s %10s %10s %10s  %s", "kind", "apparent", "allocated", "data", "path")
+
+	_, maxY := s.view.Size()
+	s.scroll(maxY - 1)
+
+	for y := 1; y < maxY && s.top+y-1 < len(s.files); y++ {
+		f := s.files[s.top+y-1]
+		ctx := TcellPrintContext{View: s.view, Style: tcell.StyleDefault, Y: y}
+		if s.top+y-1 == s.selected {
+			ctx.Style = ctx.Style.Background(tcell.ColorBlue)
+		}
+
+		data := "-"
+		if f.DataSize >= 0 {
+			data = sh.FancySize(f.DataSize)
+		}
+		ViewPrint(&ctx, "%-12s %10s %10s %10s  %s", f.Kind, sh.FancySize(f.Size), sh.FancySize(f.AllocSize), data, f.Path)
+	}
+}
+
+// close goes back to the tree.
+func (s *SparseWidget) close() {
+	buildStatus.SetStatus("")
+	panel.SetContent(s.dtw)
+	help.SetText(keysHelpMsg)
+}
+
+func (s *SparseWidget) HandleEvent(ev tcell.Event) bool {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		switch ev.Key() {
+		case tcell.KeyDown, tcell.KeyUp, tcell.KeyHome, tcell.KeyEnd:
+			s.move(ev.Key(), len(s.files))
+		case tcell.KeyEscape:
+			s.close()
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'Q', 'q':
+				app.Quit()
+			case 'S', 's':
+				s.close()
+			case 'H', 'h':
+				s.toggleFilter(dt.SparseHoles)
+			case 'P', 'p':
+				s.toggleFilter(dt.SparsePreallocated)
+			default:
+				return false
+			}
+		default:
+			return false
+		}
+		return true
+
+	case *DirtreeDrawEvent:
+		return true
+	}
+
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"flag"
@@ -16,10 +17,43 @@ import (
 )
 
 var optDebugFileName = flag.String("dbgfile", "", "File to print debug info into")
+var optSizeMode = flag.String("size", "apparent", "Size to display and sort by: apparent, allocated, both, entries or staleness")
+var optAccessTimes = flag.Bool("atime", false, "Record access times as well as modification times")
+var optSymlinks = flag.String("symlinks", "never", "Symbolic links to follow: never, top (only those in the starting directory) or always")
+var optExclude, optInclude sh.StringList
+var optFsAllow, optFsDeny sh.StringList
+
+func init() {
+	flag.Var(&optExclude, "exclude", "Pattern of files and directories to leave out. May be repeated")
+	flag.Var(&optInclude, "include", "Pattern of files to count. If specified, files that match no include pattern are left out. May be repeated")
+	flag.Var(&optFsAllow, "fsallow", "Filesystem type to read the mounts of, such as ext4. If specified, mounts of other types are left out. May be repeated")
+	flag.Var(&optFsDeny, "fsdeny", "Filesystem type to leave the mounts of out, such as nfs. May be repeated")
+}
+
+var optArchive = flag.String("archive", "", "Browse the contents of a .tar, .tar.gz, .tgz or .zip archive instead of the current directory. The allocated size is the size in the archive")
+var optImage = flag.String("image", "", "Browse a container image, either an OCI image layout directory or a docker save tarball, instead of the current directory. Press l to show each layer on its own")
+var optSave = flag.String("save", "", "Scan without showing the ui, save a snapshot of the tree to this file and exit")
+var optLoad = flag.String("load", "", "Show the snapshot saved in this file instead of scanning. With -save or -rescan, scan the directories of the snapshot again but only read those that changed since it was saved")
+var optRescan = flag.Bool("rescan", false, "With -load, scan again in the ui, reading only the directories that changed since the snapshot")
+var optWatch = flag.Bool("watch", false, "Keep the tree up to date as files change. If the inotify watch limit is reached, the directories that can't be watched are scanned again every few minutes")
+var optTypes = flag.String("types", dt.FileTypesNone.String(), "How to group files by type for the overlay shown with t: none, ext (extension) or class (MIME type)")
+var optOwners = flag.Bool("owners", false, "Record the users and groups that own files, for the overlay shown with o")
+var optSparse = flag.Bool("sparse", false, "Look for files whose allocated size differs a lot from their apparent size, shown with s")
+var optSeekData = flag.Bool("seekdata", false, "With -sparse, measure the data in the files found with SEEK_DATA and SEEK_HOLE")
+var optDirRate = flag.Float64("dirrate", 0, "Most directories to read per second, or 0 for no limit")
+var optStatRate = flag.Float64("statrate", 0, "Most files to look up per second, or 0 for no limit")
+var optAdaptive = flag.Bool("adaptive", false, "Slow down while reading directories takes much longer than usual, which is a sign the disks are busy")
+var optIOClass = flag.String("ioclass", "none", "I/O scheduling class to scan with: none (unchanged), realtime, best-effort or idle")
+var optIOLevel = flag.Int("iolevel", 4, "I/O priority within the class from 0 (highest) to 7, for the realtime and best-effort classes")
+var optHardLinks = flag.String("hardlinks", dt.DefaultBuildOpts.HardLinks.String(), "How to count files with several hard links: all (every link), first (first path seen) or shared (separate node)")
+var optDiff = flag.Bool("diff", false, "Compare the two snapshots given as arguments and print the paths that grew the most, instead of scanning")
+var optDiffCount = flag.Int("diffcount", 20, "With -diff, the number of paths to show")
 
 var app views.Application
 var status *views.Text
-var keysHelpMsg = "<enter>: expand/collapse  f: show/hide files  r: refresh"
+var panel *views.Panel
+var help *views.Text
+var keysHelpMsg = "<enter>: expand/collapse  f: show/hide files  r: refresh  a: size/entries/staleness  d: duplicates  t: types  o: owners  s: sparse files"
 
 type DirtreeOpEvent struct {
 	dt.OpData
@@ -47,8 +81,19 @@ func (e DirtreeDrawEvent) When() time.Time {
 
 func main() {
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: sph [flags] [directory...]\n       %s\n", diffUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if *optDiff {
+		if err := runDiff(flag.Args(), *optDiffCount); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+
 	if *optDebugFileName != "" {
 		f, err := os.Create(*optDebugFileName)
 		if err != nil {
@@ -62,15 +107,147 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	rootPath := "."
+	sizeMode, err := dt.ParseSizeMode(*optSizeMode)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	baseBuildOpts.HardLinks, err = dt.ParseHardLinkMode(*optHardLinks)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 
-	// Test if getting device id is supported
-	_, err := sh.GetFsDevId(rootPath)
+	baseBuildOpts.FileTypes, err = dt.ParseFileTypeMode(*optTypes)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
+	baseBuildOpts.Throttle, err = dt.NewThrottleOpts(*optDirRate, *optStatRate, *optAdaptive, *optIOClass, *optIOLevel)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if *optSparse {
+		sparse := *dt.DefaultSparseOpts
+		sparse.SeekData = *optSeekData
+		baseBuildOpts.Sparse = &sparse
+	}
+
+	baseBuildOpts.Owners = *optOwners
+	if *optOwners {
+		// Ids without names are shown as numbers.
+		userNames, _ = sh.ReadIdNames(sh.PasswdFile)
+		groupNames, _ = sh.ReadIdNames(sh.GroupFile)
+	}
+
+	_, err = dt.CompilePatterns(append(optExclude, optInclude...))
+	if err != nil {
+		fmt.Printf("Error: invalid pattern: %v\n", err)
+		return
+	}
+	baseBuildOpts.FollowSymlinks, err = dt.ParseSymlinkMode(*optSymlinks)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	baseBuildOpts.Mounts = mountOpts()
+	baseBuildOpts.AccessTimes = *optAccessTimes
+	baseBuildOpts.Exclude = optExclude
+	baseBuildOpts.Include = optInclude
+
+	var loaded *dt.Dirtree
+	if *optLoad != "" {
+		loaded, err = loadSnapshot(*optLoad)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	roots = flag.Args()
+	if loaded != nil && (*optRescan || *optSave != "") && *optArchive == "" && *optImage == "" {
+		// The snapshot is scanned again from the directories it was built from, written the same way
+		// so that the paths of the previous tree match.
+		built := snapshotRoots(loaded)
+		if len(roots) > 0 && !samePaths(roots, built) {
+			fmt.Printf("Error: %s is a snapshot of %s, not %s\n", *optLoad, strings.Join(built, ", "), strings.Join(roots, ", "))
+			return
+		}
+		roots = built
+	}
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	rootPath := roots[0]
+	if len(roots) > 1 {
+		// The path of the synthetic root of the directories.
+		rootPath = ""
+	}
+
+	var fs dt.Filesystem
+	var archive *dt.ArchiveFs
+	var image *dt.ImageFs
+
+	if *optArchive != "" && *optImage != "" {
+		fmt.Printf("Error: only one of -archive and -image may be given\n")
+		return
+	}
+
+	if (*optArchive != "" || *optImage != "") && flag.NArg() > 0 {
+		fmt.Printf("Error: directories can't be given with -archive or -image\n")
+		return
+	}
+
+	if *optImage != "" {
+		image, err = dt.OpenImage(*optImage)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		rootPath = image.Root()
+		fs = image
+		keysHelpMsg += "  l: layers"
+	} else if *optArchive != "" {
+		archive, err = dt.OpenArchive(*optArchive)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		rootPath = archive.Root()
+		fs = archive
+	} else {
+		// Test if getting device id is supported
+		for _, root := range roots {
+			_, err = sh.GetFsDevId(root)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+	}
+
+	if *optWatch && fs != nil {
+		fmt.Printf("Error: -watch can't be used with -archive or -image\n")
+		return
+	}
+
+	if *optWatch && len(roots) > 1 {
+		fmt.Printf("Error: -watch can only be used with one directory\n")
+		return
+	}
+
+	if *optSave != "" {
+		if err := saveSnapshot(fs, rootPath, *optSave, sizeMode, loaded); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+
 	screen, err := tcell.NewScreen()
 	if err != nil {
 		fmt.Printf("terminal initialization failed: %v\n", err)
@@ -87,16 +264,36 @@ func main() {
 
 	dtw := NewDirtreeWidget(screen, &errorStatus, &deleteStatus)
 	dtw.ShowRoot = true
+	dtw.dt.SizeMode = sizeMode
+	if archive != nil {
+		dtw.fs = archive
+		dtw.readOnly = true
+	}
+	if image != nil {
+		dtw.fs = image
+		dtw.image = image
+		dtw.readOnly = true
+	}
+
+	if *optWatch {
+		dtw.watcher, err = dt.NewWatcher(rootPath, &baseBuildOpts, dt.DefaultWatchOpts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer dtw.watcher.Close()
+		go dtw.watch()
+	}
 
 	app.SetScreen(screen)
 
-	panel := views.NewPanel()
+	panel = views.NewPanel()
 	panel.SetContent(dtw)
 	status = views.NewText()
 	status.SetText("Welcome to spacehoarder")
 	statusLine.setter = status
 	panel.SetStatus(status)
-	help := views.NewText()
+	help = views.NewText()
 	help.SetText(keysHelpMsg)
 	help.SetStyle(tcell.StyleDefault.Background(tcell.ColorBrown))
 	panel.SetMenu(help)
@@ -104,7 +301,16 @@ func main() {
 	app.SetRootWidget(panel)
 
 	/*** Build dirtree ***/
-	build(screen, dtw, nil, rootPath, nil, nil)
+	if loaded != nil && *optRescan {
+		opts := newBuildOpts(false)
+		opts.Previous = loaded
+		build(screen, dtw, nil, rootPath, opts, nil)
+	} else if loaded != nil {
+		dtw.setTree(loaded)
+		buildStatus.SetStatus("Loaded %s", *optLoad)
+	} else {
+		build(screen, dtw, nil, rootPath, newBuildOpts(false), nil)
+	}
 	//ops, prog := dt.Build(rootPath, dt.DefaultBuildOpts)
 	//go ApplyAll(screen, dtw.dt, &dtw.Mutex, ops)
 	//go drop(prog)
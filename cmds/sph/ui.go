@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gdamore/tcell"
 	"github.com/gdamore/tcell/views"
-	sh "github.com/jeffwilliams/spacehoarder"
 	dt "github.com/jeffwilliams/spacehoarder/dirtree"
 	"github.com/jeffwilliams/spacehoarder/tree"
 )
@@ -18,6 +19,7 @@ var (
 	buildStatus  statusPart
 	deleteStatus statusPart
 	errorStatus  statusPart
+	watchStatus  statusPart
 	statusLine   StatusLine
 )
 
@@ -26,6 +28,7 @@ func init() {
 	statusLine.Add(&buildStatus)
 	statusLine.Add(&deleteStatus)
 	statusLine.Add(&errorStatus)
+	statusLine.Add(&watchStatus)
 }
 
 type TcellPrintContext struct {
@@ -182,6 +185,25 @@ type DirtreeWidget struct {
 	errStatus           StatusSetter
 	delStatus           StatusSetter
 	remove              chan *dt.Node
+	// buildsMutex protects builds.
+	buildsMutex sync.Mutex
+	builds      []*runningBuild
+	// showingErrors is true if errStatus holds the errors of the selected node.
+	showingErrors bool
+	// fs is the filesystem that builds read. If it's nil, the local filesystem is read.
+	fs dt.Filesystem
+	// readOnly is true if paths can't be deleted from fs.
+	readOnly bool
+	// image is the container image being browsed, if any. layer is the one-based index of the
+	// layer of the image shown on its own, or zero if the whole image is shown.
+	image *dt.ImageFs
+	layer int
+	// watcher keeps the tree up to date, if it's not nil.
+	watcher *dt.Watcher
+	// overlay is the list shown over the tree for the selected directory, if any.
+	overlay overlayKind
+	// stopDupes stops the search for duplicates that is running, if it's not nil.
+	stopDupes context.CancelFunc
 }
 
 func NewDirtreeWidget(screen tcell.Screen, errStatus, delStatus StatusSetter) *DirtreeWidget {
@@ -256,6 +278,12 @@ func (w *DirtreeWidget) draw() {
 		}
 		if n.Info.Type == dt.PathTypeFile {
 			sym = "F"
+		} else if n.Info.Type == dt.PathTypeShared {
+			sym = "H"
+		} else if n.Info.Type == dt.PathTypeSymlink {
+			sym = "@"
+		} else if n.Info.Type == dt.PathTypeMount {
+			sym = "M"
 		}
 		ctx = ViewPrint(&ctx, "%s%s ", strings.Repeat(" ", depth*2), sym)
 		origStyle := ctx.Style
@@ -264,9 +292,24 @@ func (w *DirtreeWidget) draw() {
 		if !n.Info.SizeAccurate {
 			acc = "?"
 		}
-		ctx = ViewPrint(&ctx, "[%s%s]", sh.FancySize(n.Info.Size), acc)
+		ctx = ViewPrint(&ctx, "[%s%s]", n.Info.FormatSize(w.dt.SizeMode), acc)
 		ctx.Style = origStyle
-		ViewPrint(&ctx, " %s", n.Info.Basename)
+		ctx = ViewPrint(&ctx, " %s", formatAge(n.Info.NewestMtime))
+		if w.image != nil {
+			if n.Info.Layer > 0 {
+				ctx = ViewPrint(&ctx, " L%-3d", n.Info.Layer)
+			} else {
+				ctx = ViewPrint(&ctx, "     ")
+			}
+		}
+		ctx = ViewPrint(&ctx, " %s", n.Info.Basename)
+		if n.Info.Type == dt.PathTypeMount {
+			fstype := n.Info.FsType
+			if fstype == "" {
+				fstype = "other filesystem"
+			}
+			ViewPrint(&ctx, " (%s, not read)", fstype)
+		}
 	}
 
 	w.clampSelectedRow()
@@ -329,6 +372,10 @@ func (w *DirtreeWidget) draw() {
 
 	tree.Walk(w.selectedNode, visitor, tree.Forward, tree.PreOrder, depth, false)
 
+	if w.overlay != overlayNone {
+		w.drawOverlay()
+	}
+
 	if debugOrigSelectedNode != w.selectedNode {
 		ctx.X = 0
 		ctx.Y = 0
@@ -382,21 +429,25 @@ func (w *DirtreeWidget) nodeAbove() *dt.Node {
 }
 
 func (w *DirtreeWidget) refresh() {
+	if w.selectedNode != nil && w.selectedNode.Info.Type == dt.PathTypeMount {
+		buildStatus.SetStatus("%s is a mount point that is not read", w.selectedNode.Info.Path)
+		return
+	}
 	if w.selectedNode != nil {
-		w.selectedNode.UpdateSize(0, true)
+		w.selectedNode.UpdateSize(0, 0, true)
 		w.selectedNode.DelAll()
 		UnsetTreeNodeFlag(w.selectedNode, TreeNodeFlagFilesShown)
-		build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, &dt.BuildOpts{IncludeFiles: false, OneFs: true}, nil)
+		build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, newBuildOpts(false), nil)
 	}
 }
 
 func (w *DirtreeWidget) toggleFiles() {
-	if w.selectedNode != nil && w.selectedNode.Info.Type == dt.PathTypeDir {
+	if w.selectedNode != nil && (w.selectedNode.Info.Type == dt.PathTypeDir || w.selectedNode.Info.Type == dt.PathTypeSymlinkDir) {
 		// Start a new set of goroutines that will build up the list of files under the
 		// selected node.
 		// Since we are recalculating the size, we set the current size to zero and let the
 		// operations recalculate it.
-		w.selectedNode.UpdateSize(0, true)
+		w.selectedNode.UpdateSize(0, 0, true)
 		w.selectedNode.DelAll()
 		flags := treeNodeFlags(w.selectedNode)
 		// toggle
@@ -404,18 +455,85 @@ func (w *DirtreeWidget) toggleFiles() {
 			onAdd := func(n *dt.Node) {
 				UnsetTreeNodeFlag(n, TreeNodeFlagFilesShown)
 			}
-			build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, &dt.BuildOpts{IncludeFiles: false, OneFs: true}, onAdd)
+			build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, newBuildOpts(false), onAdd)
 			UnsetTreeNodeFlag(w.selectedNode, TreeNodeFlagFilesShown)
 		} else {
 			onAdd := func(n *dt.Node) {
 				SetTreeNodeFlag(n, TreeNodeFlagFilesShown)
 			}
-			build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, &dt.BuildOpts{IncludeFiles: true, OneFs: true}, onAdd)
+			build(w.screen, w, w.selectedNode, w.selectedNode.Info.Path, newBuildOpts(true), onAdd)
 			SetTreeNodeFlag(w.selectedNode, TreeNodeFlagFilesShown)
 		}
 	}
 }
 
+// formatAge formats the number of days since t for the last modified column.
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "    -"
+	}
+	return fmt.Sprintf("%4dd", int(time.Since(t).Hours()/24))
+}
+
+// cycleSizeMode switches the size that is displayed and used for sorting
+// between apparent, allocated, both, number of entries and staleness.
+func (w *DirtreeWidget) cycleSizeMode() {
+	w.Mutex.Lock()
+	w.dt.SetSizeMode((w.dt.SizeMode + 1) % (dt.SizeModeStaleness + 1))
+	w.errStatus.SetStatus("Showing %s size", w.dt.SizeMode)
+	w.Mutex.Unlock()
+}
+
+// cycleLayer switches between showing the whole container image and showing each of its
+// layers on its own. The tree is rebuilt from the root.
+func (w *DirtreeWidget) cycleLayer() {
+	if w.image == nil {
+		return
+	}
+
+	w.Mutex.Lock()
+	w.layer = (w.layer + 1) % (w.image.Layers() + 1)
+	if w.layer == 0 {
+		w.fs = w.image
+		w.errStatus.SetStatus("Showing all layers")
+	} else {
+		w.fs = w.image.Layer(w.layer)
+		w.errStatus.SetStatus("Showing layer %d of %d", w.layer, w.image.Layers())
+	}
+
+	tree := dt.New()
+	tree.SortChildren = true
+	tree.SizeMode = w.dt.SizeMode
+	w.dt = tree
+	w.selectedNode = nil
+	w.toDelete = nil
+	w.Mutex.Unlock()
+
+	build(w.screen, w, nil, w.image.Root(), newBuildOpts(false), nil)
+}
+
+// showErrors displays the errors that occurred reading the selected node, if any.
+func (w *DirtreeWidget) showErrors() {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.selectedNode == nil || len(w.selectedNode.Info.Errors) == 0 {
+		if w.showingErrors {
+			w.errStatus.SetStatus("")
+			w.showingErrors = false
+		}
+		return
+	}
+
+	errs := w.selectedNode.Info.Errors
+	if len(errs) > 1 {
+		w.errStatus.SetStatus("%v (and %d more errors)", errs[0], len(errs)-1)
+	} else {
+		w.errStatus.SetStatus("%v", errs[0])
+	}
+	w.showingErrors = true
+}
+
 func (w *DirtreeWidget) toggleExpanded() {
 	if w.selectedNode != nil {
 		w.Mutex.Lock()
@@ -523,7 +641,7 @@ func (w *DirtreeWidget) remover() {
 			n.Parent.Add(n)
 			w.Mutex.Unlock()
 			// Rebuild the node in case some but not all of the descendants were deleted.
-			build(w.screen, w, n, n.Info.Path, &dt.BuildOpts{IncludeFiles: false, OneFs: true}, nil)
+			build(w.screen, w, n, n.Info.Path, newBuildOpts(false), nil)
 		}
 	}
 }
@@ -546,6 +664,18 @@ func (w *DirtreeWidget) HandleEvent(ev tcell.Event) bool {
 				w.toggleFiles()
 			case 'R', 'r':
 				w.refresh()
+			case 'A', 'a':
+				w.cycleSizeMode()
+			case 'L', 'l':
+				w.cycleLayer()
+			case 'D', 'd':
+				w.findDuplicates()
+			case 'T', 't':
+				w.toggleOverlay(overlayTypes)
+			case 'O', 'o':
+				w.toggleOverlay(overlayOwners)
+			case 'S', 's':
+				w.showSparse()
 			case 'Y', 'y':
 				if w.toDelete != nil {
 					w.delStatus.SetStatus("")
@@ -579,7 +709,13 @@ func (w *DirtreeWidget) HandleEvent(ev tcell.Event) bool {
 			w.selectFirst()
 		case tcell.KeyEnd:
 			w.selectLast()
+		case tcell.KeyEscape:
+			w.stopDuplicates()
 		case tcell.KeyDelete:
+			if w.readOnly || (w.selectedNode != nil && w.selectedNode.Info.Type == dt.PathTypeMulti) {
+				w.delStatus.SetStatus("Deleting is not supported here")
+				break
+			}
 			defer func() {
 				w.toDelete = w.selectedNode
 				w.delStatus.SetStatus("Type 'y' to confirm delete")
@@ -589,6 +725,7 @@ func (w *DirtreeWidget) HandleEvent(ev tcell.Event) bool {
 		}
 		// User did not confirm delete
 		unstageDelete()
+		w.showErrors()
 		return handled
 
 	case *DirtreeDrawEvent:
@@ -3,18 +3,99 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	sh "github.com/jeffwilliams/spacehoarder"
 	"github.com/jeffwilliams/spacehoarder/dirtree"
 	"net"
+	"os"
+	"os/signal"
 )
 
 // Run as a server for debugging.
 var optServer = flag.Bool("server", false, "For debugging. Run as a server and print out data sent by client.")
 var optHelp = flag.Bool("h", false, "Show help")
+var optSizeMode = flag.String("size", "both", "Sizes to compute: apparent, allocated or both")
+var optAccessTimes = flag.Bool("atime", false, "Record access times as well as modification times")
+var optSymlinks = flag.String("symlinks", "never", "Symbolic links to follow: never, top (only those in the starting directory) or always")
+var optExclude, optInclude sh.StringList
+var optFsAllow, optFsDeny sh.StringList
+
+func init() {
+	flag.Var(&optExclude, "exclude", "Pattern of files and directories to leave out. May be repeated")
+	flag.Var(&optInclude, "include", "Pattern of files to count. If specified, files that match no include pattern are left out. May be repeated")
+	flag.Var(&optFsAllow, "fsallow", "Filesystem type to read the mounts of, such as ext4. If specified, mounts of other types are left out. May be repeated")
+	flag.Var(&optFsDeny, "fsdeny", "Filesystem type to leave the mounts of out, such as nfs. May be repeated")
+}
+
+var optDirRate = flag.Float64("dirrate", 0, "Most directories to read per second, or 0 for no limit")
+var optStatRate = flag.Float64("statrate", 0, "Most files to look up per second, or 0 for no limit")
+var optAdaptive = flag.Bool("adaptive", false, "Slow down while reading directories takes much longer than usual, which is a sign the disks are busy")
+var optIOClass = flag.String("ioclass", "none", "I/O scheduling class to scan with: none (unchanged), realtime, best-effort or idle")
+var optIOLevel = flag.Int("iolevel", 4, "I/O priority within the class from 0 (highest) to 7, for the realtime and best-effort classes")
+var optHardLinks = flag.String("hardlinks", dirtree.DefaultBuildOpts.HardLinks.String(), "How to count files with several hard links: all (every link), first (first path seen) or shared (separate node)")
+
+// mountOpts returns the options that select the mounts to read by type, or nil if the flags select none.
+func mountOpts() *dirtree.MountOpts {
+	if len(optFsAllow) == 0 && len(optFsDeny) == 0 {
+		return nil
+	}
+	return &dirtree.MountOpts{Allow: optFsAllow, Deny: optFsDeny}
+}
 
 func doclient(basedir string, addr string) {
-	ops, prog := dirtree.Build(basedir, dirtree.DefaultBuildOpts)
+	sizeMode, err := dirtree.ParseSizeMode(*optSizeMode)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	hardLinks, err := dirtree.ParseHardLinkMode(*optHardLinks)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	symlinks, err := dirtree.ParseSymlinkMode(*optSymlinks)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	_, err = dirtree.CompilePatterns(append(optExclude, optInclude...))
+	if err != nil {
+		fmt.Println("Invalid pattern:", err)
+		return
+	}
+
+	throttle, err := dirtree.NewThrottleOpts(*optDirRate, *optStatRate, *optAdaptive, *optIOClass, *optIOLevel)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	opts := *dirtree.DefaultBuildOpts
+	opts.SizeMode = sizeMode
+	opts.HardLinks = hardLinks
+	opts.FollowSymlinks = symlinks
+	opts.AccessTimes = *optAccessTimes
+	opts.Exclude = optExclude
+	opts.Include = optInclude
+	opts.Throttle = throttle
+	opts.Mounts = mountOpts()
+	// Stop the build on interrupt. The server is told that the build is incomplete.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	ops, prog := dirtree.BuildContext(ctx, basedir, &opts)
 
 	opConn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -59,7 +140,7 @@ func doserver() {
 	listener.Close()
 
 	ops := make(chan dirtree.OpData)
-	prog := make(chan string)
+	prog := make(chan dirtree.Progress)
 
 	dirtree.Decode(opConn, progConn, ops, prog)
 
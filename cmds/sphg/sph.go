@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	sh "github.com/jeffwilliams/spacehoarder"
 	"github.com/jeffwilliams/spacehoarder/dirtree"
 	"github.com/jeffwilliams/spacehoarder/ui"
 	"github.com/jeffwilliams/squarify"
@@ -22,6 +21,10 @@ import (
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var server = flag.Bool("server", false, "Run as a server and wait for input from sphclient")
 var refreshMilli = flag.Uint("refresh", 80, "Minimum duration between screen refreshes in ms")
+var optSizeMode = flag.String("size", "apparent", "Size to display: apparent, allocated, entries or staleness")
+var optSave = flag.String("save", "", "Save a snapshot of the tree to this file once it's complete")
+var optLoad = flag.String("load", "", "Display the snapshot saved in this file instead of scanning. No directory is needed")
+var optArchive = flag.Bool("archive", false, "Treat the argument as a .tar, .tar.gz, .tgz or .zip archive and display its contents. The allocated size is the size in the archive")
 
 func makeUi() (*gtk.Window, *gtk.DrawingArea, *gtk.Label) {
 	gtk.Init(nil)
@@ -73,11 +76,12 @@ func writeSvg(w io.Writer, blocks []squarify.Block) {
 type RendererContext struct {
 	maxDepth  int
 	margins   squarify.Margins
+	sizeMode  dirtree.SizeMode
 	ops       chan dirtree.OpData
-	prog      chan string
+	prog      chan dirtree.Progress
 	resize    chan struct{}
 	setPixmap func(p *gdk.Pixmap)
-	processed func(file string)
+	processed func(p dirtree.Progress)
 	complete  func(t *dirtree.Dirtree)
 	style     *ui.Style
 	area      *gtk.DrawingArea
@@ -107,6 +111,7 @@ func outputSvg(ctx *RendererContext, tree *dirtree.Dirtree, filename string) {
 // and repeatedly renders it into a pixmap that is passed to setPixmap
 func PixmapRenderer(ctx *RendererContext, renderDeadline time.Duration) {
 	tree := dirtree.New()
+	tree.SizeMode = ctx.sizeMode
 
 	render := func() {
 		if tree.Root == nil {
@@ -178,6 +183,19 @@ loop:
 
 }
 
+// saveTree saves a snapshot of the tree t to the file name.
+func saveTree(t *dirtree.Dirtree, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := t.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 type ExposeReason int
 
 const (
@@ -186,7 +204,7 @@ const (
 	UpdateProcessedFile
 )
 
-func startServer() (ops chan dirtree.OpData, prog chan string, err error) {
+func startServer() (ops chan dirtree.OpData, prog chan dirtree.Progress, err error) {
 	err = nil
 
 	// Listen on a random port
@@ -224,7 +242,7 @@ func startServer() (ops chan dirtree.OpData, prog chan string, err error) {
 	listener.Close()
 
 	ops = make(chan dirtree.OpData)
-	prog = make(chan string)
+	prog = make(chan dirtree.Progress)
 
 	dirtree.Decode(opConn, progConn, ops, prog)
 
@@ -245,8 +263,14 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if flag.NArg() < 1 {
-		fmt.Println("Usage: sphg <directory>")
+	if flag.NArg() < 1 && *optLoad == "" {
+		fmt.Println("Usage: sphg <directory>...\n       sphg -archive <archive>\n       sphg -load <snapshot>")
+		os.Exit(1)
+	}
+
+	sizeMode, err := dirtree.ParseSizeMode(*optSizeMode)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
@@ -254,14 +278,28 @@ func main() {
 
 	// The pointer to the pixmap that the UI thread will draw on expose events.
 	var pixmap *gdk.Pixmap
-	// File just processed.
-	var lastFile string
+	// Text of the progress label: the progress of the build, or the result once it's complete.
+	var progressText string
 	// Reason we generated expose_event
 	exposeReason := NoReason
 
 	var ops chan dirtree.OpData
-	var prog chan string
-	if *server {
+	var prog chan dirtree.Progress
+	if *optLoad != "" {
+		f, err := os.Open(*optLoad)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		tree, err := dirtree.Load(f)
+		f.Close()
+		if err != nil {
+			fmt.Println("Loading", *optLoad, "failed:", err)
+			os.Exit(1)
+		}
+		ops = make(chan dirtree.OpData)
+		go tree.Replay(ops)
+	} else if *server {
 		// Wait for remote connection
 		var err error
 		ops, prog, err = startServer()
@@ -270,7 +308,20 @@ func main() {
 		}
 	} else {
 		// Run locally. Start goroutine that explores the directories
-		ops, prog = dirtree.Build(flag.Arg(0), dirtree.DefaultBuildOpts)
+		opts := *dirtree.DefaultBuildOpts
+		opts.SizeMode = sizeMode
+		if *optArchive {
+			archive, err := dirtree.OpenArchive(flag.Arg(0))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			ops, prog = dirtree.BuildFs(archive, archive.Root(), &opts)
+		} else if flag.NArg() > 1 {
+			ops, prog = dirtree.BuildMulti(flag.Args(), &opts)
+		} else {
+			ops, prog = dirtree.Build(flag.Arg(0), &opts)
+		}
 	}
 
 	_, area, progressLabel := makeUi()
@@ -294,6 +345,7 @@ func main() {
 	ctx := &RendererContext{
 		maxDepth: 6,
 		margins:  squarify.Margins{3, 3, 20, 3},
+		sizeMode: sizeMode,
 		ops:      ops,
 		prog:     prog,
 		style:    style,
@@ -310,17 +362,24 @@ func main() {
 		area.Widget.Emit("expose_event")
 	}
 
-	ctx.processed = func(file string) {
-		lastFile = file
+	ctx.processed = func(p dirtree.Progress) {
+		progressText = p.String()
 		exposeReason = UpdateProcessedFile
 		area.Widget.Emit("expose_event")
 	}
 
 	ctx.complete = func(t *dirtree.Dirtree) {
 		if t.Root != nil {
-			lastFile = "Completed. Size: " + sh.FancySize(t.Root.Info.Size)
+			progressText = "Completed. Size: " + t.Root.Info.FormatSize(t.SizeMode)
 		} else {
-			lastFile = "Completed. "
+			progressText = "Completed. "
+		}
+		if *optSave != "" {
+			if err := saveTree(t, *optSave); err != nil {
+				progressText += " Saving failed: " + err.Error()
+			} else {
+				progressText += " Saved to " + *optSave
+			}
 		}
 		exposeReason = UpdateProcessedFile
 		area.Widget.Emit("expose_event")
@@ -338,7 +397,7 @@ func main() {
 			area.GetWindow().GetDrawable().DrawDrawable(gc, pixmap.GetDrawable(), 0, 0, 0, 0, -1, -1)
 		}
 		if exposeReason == NoReason || exposeReason == UpdateProcessedFile {
-			progressLabel.SetText(lastFile)
+			progressLabel.SetText(progressText)
 		}
 		exposeReason = NoReason
 	})
@@ -0,0 +1,354 @@
+package dirtree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ArchiveFs is a Filesystem that presents the contents of a tar or zip archive as a directory tree.
+// The whole tree is under a root directory named after the archive, which is the path to build from.
+//
+// The apparent size of a file is its uncompressed size. The allocated size is the compressed size
+// for zip archives, and the number of bytes the file and its header occupy in the tar stream
+// for tar archives. Symbolic links in the archive are never followed.
+type ArchiveFs struct {
+	root string
+	// Map the path of each entry, relative to the root, to the entry.
+	entries map[string]*archiveEntry
+	// Map the path of each directory, relative to the root, to the paths of its entries in the order they were added.
+	children map[string][]string
+}
+
+// archiveEntry describes a file or directory in an archive.
+type archiveEntry struct {
+	name      string
+	size      int64
+	allocSize int64
+	mode      os.FileMode
+	mtime     time.Time
+	// layer is the image layer the entry came from, or zero.
+	layer int
+}
+
+func (e *archiveEntry) Name() string {
+	return e.name
+}
+
+func (e *archiveEntry) Size() int64 {
+	return e.size
+}
+
+func (e *archiveEntry) Mode() os.FileMode {
+	return e.mode
+}
+
+func (e *archiveEntry) ModTime() time.Time {
+	return e.mtime
+}
+
+func (e *archiveEntry) IsDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *archiveEntry) Sys() interface{} {
+	return nil
+}
+
+// AllocSize returns the size of the entry in the archive.
+func (e *archiveEntry) AllocSize() int64 {
+	return e.allocSize
+}
+
+// Layer returns the one-based index of the image layer the entry came from, or zero if the
+// archive is not a container image.
+func (e *archiveEntry) Layer() int {
+	return e.layer
+}
+
+// allocSizer is implemented by the os.FileInfo of files that are not stored on disk, to report
+// the size allocated for them.
+type allocSizer interface {
+	AllocSize() int64
+}
+
+// layerer is implemented by the os.FileInfo of files in container images, to report the
+// layer the file came from.
+type layerer interface {
+	Layer() int
+}
+
+// fileLayer returns the image layer the file fi came from, or zero.
+func fileLayer(fi os.FileInfo) int {
+	if l, ok := fi.(layerer); ok {
+		return l.Layer()
+	}
+	return 0
+}
+
+func newArchiveFs(root string) *ArchiveFs {
+	a := &ArchiveFs{
+		root:     root,
+		entries:  make(map[string]*archiveEntry),
+		children: make(map[string][]string),
+	}
+	a.entries["."] = &archiveEntry{name: root, mode: os.ModeDir | 0755}
+	return a
+}
+
+// OpenArchive reads the index of the archive in the file name. The format is chosen by the
+// extension of the name, which must be one of .tar, .tar.gz, .tgz or .zip.
+func OpenArchive(name string) (*ArchiveFs, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	root := filepath.Base(name)
+	lower := strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return NewZipFs(f, fi.Size(), root)
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return NewTarFs(gz, root)
+	case strings.HasSuffix(lower, ".tar"):
+		return NewTarFs(f, root)
+	}
+
+	return nil, fmt.Errorf("Unknown archive format for '%s'. The name must end in .tar, .tar.gz, .tgz or .zip", name)
+}
+
+// tarBlockSize is the size of the blocks a tar stream is made of.
+const tarBlockSize = 512
+
+// NewTarFs reads the uncompressed tar stream r and returns an ArchiveFs for its contents under
+// the directory root.
+func NewTarFs(r io.Reader, root string) (*ArchiveFs, error) {
+	a := newArchiveFs(root)
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		a.add(hdr.Name, newTarEntry(hdr))
+	}
+
+	return a, nil
+}
+
+// newTarEntry returns the entry for the tar header hdr.
+func newTarEntry(hdr *tar.Header) *archiveEntry {
+	size := hdr.Size
+	if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink {
+		size = 0
+	}
+
+	// The header and the contents padded to a whole block.
+	allocSize := tarBlockSize + (size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+	return &archiveEntry{size: size, allocSize: allocSize, mode: hdr.FileInfo().Mode(), mtime: hdr.ModTime}
+}
+
+// NewZipFs reads the zip archive r of the specified size and returns an ArchiveFs for its contents
+// under the directory root.
+func NewZipFs(r io.ReaderAt, size int64, root string) (*ArchiveFs, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newArchiveFs(root)
+	for _, f := range zr.File {
+		a.add(f.Name, &archiveEntry{
+			size:      int64(f.UncompressedSize64),
+			allocSize: int64(f.CompressedSize64),
+			mode:      f.Mode(),
+			mtime:     f.Modified,
+		})
+	}
+
+	return a, nil
+}
+
+// archivePath returns the path relative to the root of the entry with the path name in an archive.
+func archivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// add adds the entry e with the path name in the archive, creating the directories that contain it.
+// If an entry with the same path was already added, it's replaced, but the entries under it are kept.
+func (a *ArchiveFs) add(name string, e *archiveEntry) {
+	p := archivePath(name)
+	if p == "" {
+		// The archive's own root.
+		return
+	}
+
+	dir := path.Dir(p)
+	a.mkdirs(dir, e.layer)
+
+	e.name = path.Base(p)
+	if old, ok := a.entries[p]; ok {
+		*old = *e
+		return
+	}
+	a.entries[p] = e
+	a.children[dir] = append(a.children[dir], p)
+}
+
+// remove removes the entry with the relative path p and the entries under it.
+func (a *ArchiveFs) remove(p string) {
+	if _, ok := a.entries[p]; !ok || p == "." {
+		return
+	}
+
+	a.removeChildren(p, func(*archiveEntry) bool { return true })
+	delete(a.entries, p)
+
+	dir := path.Dir(p)
+	children := a.children[dir]
+	for i, c := range children {
+		if c == p {
+			a.children[dir] = append(children[:i:i], children[i+1:]...)
+			break
+		}
+	}
+}
+
+// removeChildren removes the entries in the directory with the relative path p for which
+// match returns true, and the entries under them.
+func (a *ArchiveFs) removeChildren(p string, match func(e *archiveEntry) bool) {
+	var kept []string
+	for _, c := range a.children[p] {
+		if match(a.entries[c]) {
+			a.removeChildren(c, func(*archiveEntry) bool { return true })
+			delete(a.entries, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	a.children[p] = kept
+	if kept == nil {
+		delete(a.children, p)
+	}
+}
+
+// mkdirs creates the directory p and its parents if they don't exist, as part of layer.
+func (a *ArchiveFs) mkdirs(p string, layer int) {
+	if _, ok := a.entries[p]; ok {
+		return
+	}
+
+	dir := path.Dir(p)
+	a.mkdirs(dir, layer)
+	a.entries[p] = &archiveEntry{name: path.Base(p), mode: os.ModeDir | 0755, layer: layer}
+	a.children[dir] = append(a.children[dir], p)
+}
+
+// Root returns the path of the directory that contains the archive contents.
+func (a *ArchiveFs) Root() string {
+	return a.root
+}
+
+// lookup returns the entry for the path p.
+func (a *ArchiveFs) lookup(op, p string) (*archiveEntry, string, error) {
+	rel := ""
+	if p == a.root {
+		rel = "."
+	} else if strings.HasPrefix(p, a.root+string(os.PathSeparator)) {
+		rel = strings.TrimPrefix(path.Clean("/"+p[len(a.root)+1:]), "/")
+		if rel == "" {
+			rel = "."
+		}
+	}
+
+	e, ok := a.entries[rel]
+	if !ok {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return e, rel, nil
+}
+
+// Open opens the directory with the specified path.
+func (a *ArchiveFs) Open(p string) (file File, err error) {
+	e, rel, err := a.lookup("open", p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	d := &archiveDir{}
+	for _, c := range a.children[rel] {
+		d.entries = append(d.entries, a.entries[c])
+	}
+	return d, nil
+}
+
+// DeviceId returns the same identifier for every path in the archive.
+func (a *ArchiveFs) DeviceId(p string) (id uint64, err error) {
+	if _, _, err := a.lookup("stat", p); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// archiveDir is an open directory of an ArchiveFs.
+type archiveDir struct {
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *archiveDir) Close() error {
+	return nil
+}
+
+func (d *archiveDir) Readdir(count int) ([]os.FileInfo, error) {
+	n := len(d.entries) - d.pos
+	if count > 0 && n > count {
+		n = count
+	}
+	if n == 0 && count > 0 {
+		return nil, io.EOF
+	}
+
+	fis := d.entries[d.pos : d.pos+n]
+	d.pos += n
+	return fis, nil
+}
+
+func (d *archiveDir) ReadDir(count int) ([]iofs.DirEntry, error) {
+	fis, err := d.Readdir(count)
+
+	des := make([]iofs.DirEntry, len(fis))
+	for i, fi := range fis {
+		des[i] = iofs.FileInfoToDirEntry(fi)
+	}
+	return des, err
+}
@@ -0,0 +1,102 @@
+package dirtree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+// archiveFiles are the files put into the test archives, by path.
+var archiveFiles = []struct {
+	name string
+	size int
+}{
+	{"a/file1.txt", 20},
+	{"a/file2.txt", 10},
+	{"b/a.txt", 5},
+	{"b/dir/blort", 1000},
+}
+
+func buildArchive(t *testing.T, a *ArchiveFs) *Dirtree {
+	opts := *DefaultBuildOpts
+	opts.SizeMode = SizeModeBoth
+
+	ops := make(chan OpData)
+	go build(a, a.Root(), ops, nil, &opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+	return tree
+}
+
+func checkArchiveTree(t *testing.T, tree *Dirtree, expected map[string][2]int64) {
+	detected := 0
+	tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		sizes := [2]int64{n.Info.Size, n.Info.AllocSize}
+		if sizes != expected[n.Info.Basename] {
+			t.Fatal("Directory", n.Info.Path, "should have sizes", expected[n.Info.Basename], "but has", sizes)
+		}
+		detected++
+		return true, false
+	}, 0)
+
+	if detected != len(expected) {
+		t.Fatal("Tree should have", len(expected), "directories but has", detected)
+	}
+}
+
+func TestTarFs(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	// Only one of the directories has its own header.
+	w.WriteHeader(&tar.Header{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range archiveFiles {
+		w.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Size: int64(f.size), Mode: 0644})
+		w.Write(make([]byte, f.size))
+	}
+	w.Close()
+
+	a, err := NewTarFs(&buf, "test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file takes a header block and its padded contents.
+	checkArchiveTree(t, buildArchive(t, a), map[string][2]int64{
+		"test.tar": {1035, 4608},
+		"a":        {30, 2048},
+		"b":        {1005, 2560},
+		"dir":      {1000, 1536},
+	})
+}
+
+func TestZipFs(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range archiveFiles {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(make([]byte, f.size))
+	}
+	w.Close()
+
+	a, err := NewZipFs(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := buildArchive(t, a)
+	if tree.Root.Info.Size != 1035 {
+		t.Fatal("Root should have uncompressed size 1035 but has", tree.Root.Info.Size)
+	}
+	// The zeroed contents compress well.
+	if tree.Root.Info.AllocSize <= 0 || tree.Root.Info.AllocSize >= tree.Root.Info.Size {
+		t.Fatal("Root should have a compressed size smaller than 1035 but has", tree.Root.Info.AllocSize)
+	}
+	if tree.Root.Info.Dirs != 3 || tree.Root.Info.Files != 4 {
+		t.Fatal("Root should contain 3 directories and 4 files but contains", tree.Root.Info.Dirs, "and", tree.Root.Info.Files)
+	}
+}
@@ -1,10 +1,15 @@
 package dirtree
 
 import (
+	"context"
+	"fmt"
 	sh "github.com/jeffwilliams/spacehoarder"
 	"io"
+	iofs "io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +20,12 @@ const (
 	Push Op = iota
 	Pop
 	AddSize
+	// Incomplete is the last operation of a build that was cancelled. The directories that
+	// were pushed but whose sizes were not added are marked as inaccurate.
+	Incomplete
+	// Error records that reading a path under the current directory failed. The current
+	// directory is marked as inaccurate.
+	Error
 )
 
 // OpData is an operation on a DirTree and it's corresponding data.
@@ -23,8 +34,37 @@ type OpData struct {
 	Path         string
 	Basename     string
 	Size         int64
+	AllocSize    int64
+	SharedSize   int64
+	Files        int64
+	Dirs         int64
+	Other        int64
 	SizeAccurate bool
 	Type         PathType
+	// Err is the error for an Error operation.
+	Err *ScanError
+	// Layer is the last container image layer that contributed bytes, or zero.
+	Layer int
+	// ModTime and ChangeTime of the directory itself, for AddSize operations.
+	ModTime, ChangeTime time.Time
+	// Types of the files counted in the operation, if the build groups files by type. Only the operations
+	// for directories have them; the types of the files included in the build are counted in their directory.
+	Types TypeHistogram
+	// Users and Groups that own the files counted in the operation, if the build records owners. Like
+	// Types, only the operations for directories have them.
+	Users, Groups OwnerHistogram
+	// Sparse lists the files of the directory whose allocated size differs a lot from their apparent
+	// size, for AddSize operations.
+	Sparse []*SparseFile
+	// FsType is the type of the filesystem mounted at a PathTypeMount entry, if it's known.
+	FsType string
+	Times
+}
+
+// sizes returns a PathInfo holding the sizes in op.
+func (op *OpData) sizes() *PathInfo {
+	return &PathInfo{Size: op.Size, AllocSize: op.AllocSize, SharedSize: op.SharedSize, Files: op.Files, Dirs: op.Dirs, Other: op.Other, Layer: op.Layer, Types: op.Types,
+		Users: op.Users, Groups: op.Groups, Times: op.Times}
 }
 
 // Filesystem is an abstraction of a filesystem used by BuildFs.
@@ -41,6 +81,10 @@ type Filesystem interface {
 type File interface {
 	io.Closer
 	Readdir(count int) ([]os.FileInfo, error)
+	// ReadDir reads up to count entries of the directory, in the same way as os.File.ReadDir.
+	// Builds read directories in batches with ReadDir, and only look up the information
+	// for an entry if its type is not enough.
+	ReadDir(count int) ([]iofs.DirEntry, error)
 }
 
 // OsFilesystem is a Filesystem that performs as expected; that is,
@@ -56,39 +100,184 @@ func (r OsFilesystem) DeviceId(path string) (id uint64, err error) {
 	return sh.GetFsDevId(path)
 }
 
+// Stat returns information about the file the path refers to, following symbolic links.
+func (r OsFilesystem) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// StatFilesystem is a Filesystem that can also describe the file a path refers to,
+// following symbolic links. Symbolic links are only followed on a StatFilesystem.
+type StatFilesystem interface {
+	Filesystem
+	Stat(path string) (os.FileInfo, error)
+}
+
+// SymlinkMode selects which symbolic links are followed during a build.
+type SymlinkMode uint8
+
+const (
+	// SymlinksNever doesn't follow symbolic links.
+	SymlinksNever SymlinkMode = iota
+	// SymlinksTopLevel only follows the symbolic links in the directory the build starts from.
+	SymlinksTopLevel
+	// SymlinksAlways follows all symbolic links.
+	SymlinksAlways
+)
+
+var symlinkModeNames = []string{"never", "top", "always"}
+
+func (m SymlinkMode) String() string {
+	if int(m) < len(symlinkModeNames) {
+		return symlinkModeNames[m]
+	}
+	return fmt.Sprintf("SymlinkMode(%d)", m)
+}
+
+// ParseSymlinkMode returns the SymlinkMode with the name s, as returned by SymlinkMode.String.
+func ParseSymlinkMode(s string) (SymlinkMode, error) {
+	for i, v := range symlinkModeNames {
+		if v == s {
+			return SymlinkMode(i), nil
+		}
+	}
+	return SymlinksNever, fmt.Errorf("Unknown symlink mode '%s'. Must be one of never, top or always", s)
+}
+
+// HardLinkMode selects how the size of a file with more than one hard link is counted.
+type HardLinkMode uint8
+
+const (
+	// HardLinksCountAll counts the size of the file once for every link to it.
+	HardLinksCountAll HardLinkMode = iota
+	// HardLinksFirstPath counts the size of the file under the first path seen that links to it.
+	HardLinksFirstPath
+	// HardLinksShared counts the size of the file once, in a node of type PathTypeShared
+	// under the root of the build.
+	HardLinksShared
+)
+
+var hardLinkModeNames = []string{"all", "first", "shared"}
+
+func (m HardLinkMode) String() string {
+	if int(m) < len(hardLinkModeNames) {
+		return hardLinkModeNames[m]
+	}
+	return fmt.Sprintf("HardLinkMode(%d)", m)
+}
+
+// ParseHardLinkMode returns the HardLinkMode with the name s, as returned by HardLinkMode.String.
+func ParseHardLinkMode(s string) (HardLinkMode, error) {
+	for i, v := range hardLinkModeNames {
+		if v == s {
+			return HardLinkMode(i), nil
+		}
+	}
+	return HardLinksCountAll, fmt.Errorf("Unknown hard link mode '%s'. Must be one of all, first or shared", s)
+}
+
+// SharedBasename is the basename of the node that holds the size of hard linked files
+// when building with HardLinksShared.
+const SharedBasename = "<hard links>"
+
 type BuildOpts struct {
-	// If the walk would cross into another filesystem, do not traverse it.
+	// If the walk would cross into another filesystem, do not traverse it. The mount points that are
+	// not traversed are included as entries of type PathTypeMount.
 	OneFs bool
 	// Include files in the output.
 	IncludeFiles bool
+	// Workers is the number of goroutines that read directories concurrently.
+	// A value less than 2 reads each directory from the building goroutine.
+	Workers int
+	// SizeMode selects which sizes of files are counted. If the allocated size of a file
+	// can't be determined, its apparent size is used instead.
+	SizeMode SizeMode
+	// HardLinks selects how files with more than one hard link are counted.
+	HardLinks HardLinkMode
+	// Exclude is a list of patterns, as described for Pattern. Files and directories that
+	// match are left out of the build, and excluded directories are not read. Invalid patterns are ignored.
+	Exclude []string
+	// Include is a list of patterns, as described for Pattern. If it's not empty, only files
+	// that match one of the patterns are counted. Directories are read unless they are excluded.
+	Include []string
+	// FollowSymlinks selects which symbolic links are followed. A symbolic link to a directory
+	// that was already reached in the build, or that is in the same directory as the link, is not
+	// followed, which prevents loops. A link to a directory elsewhere that is only reached later is
+	// followed, and the directory is counted in both places. Symbolic links that are not followed
+	// are included as entries of type PathTypeSymlink when files are included.
+	FollowSymlinks SymlinkMode
+	// AccessTimes records the range of access times of each path in addition to modification times.
+	AccessTimes bool
+	// Previous is a tree built earlier from the same path with the same options, such as one loaded
+	// from a snapshot. If it's not nil, the build is incremental, as described for BuildIncremental.
+	// It must not be modified during the build.
+	Previous *Dirtree
+	// FileTypes selects how the files are grouped by type in PathInfo.Types.
+	FileTypes FileTypeMode
+	// Owners records the totals of the files owned by each user and group in PathInfo.Users and PathInfo.Groups.
+	Owners bool
+	// Sparse, if it's not nil, selects the files whose allocated size differs a lot from their apparent
+	// size, which are listed in PathInfo.Sparse.
+	Sparse *SparseOpts
+	// Throttle, if it's not nil, limits the load that the build puts on the filesystem. Directories read
+	// again with ReadDirUpdate are not throttled.
+	Throttle *ThrottleOpts
+	// Mounts, if it's not nil, selects the filesystems mounted under the root that are read by their type.
+	// Mount points of the types that are allowed are traversed even with OneFs, and the others are
+	// included as entries of type PathTypeMount.
+	Mounts *MountOpts
+	// Root is the directory the tree was built from, when the build reads again a directory under it.
+	// Patterns and SymlinksTopLevel are relative to Root, and with HardLinksShared the files with more
+	// than one hard link are left to the node of type PathTypeShared under Root. If it's empty, the
+	// directory the build starts from is the root.
+	Root string
 }
 
 var DefaultBuildOpts = &BuildOpts{
 	OneFs:        true,
 	IncludeFiles: false,
+	Workers:      runtime.NumCPU(),
+	HardLinks:    HardLinksFirstPath,
 }
 
 // Build builds a new Dirtree starting from the specified directory `basepath` and writes all
 // the operations performed to the Dirtree to the ops channel so that a copy of the Dirtree can be
-// made in a different goroutine. The paths processed are written to the channel prog.
-func Build(basepath string, opts *BuildOpts) (ops chan OpData, prog chan string) {
+// made in a different goroutine. The progress of the build is written to the channel prog.
+func Build(basepath string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
 	return BuildFs(OsFilesystem{}, basepath, opts)
 }
 
+// BuildContext is like Build, but stops when ctx is done. In that case an Incomplete
+// operation is written to ops before both channels are closed, unless ops is not read for
+// some time after ctx is done.
+func BuildContext(ctx context.Context, basepath string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+	return BuildFsContext(ctx, OsFilesystem{}, basepath, opts)
+}
+
 // BuildFs builds a new Dirtree starting from the specified directory `basepath` and writes all
 // the operations performed to the Dirtree to the ops channel so that a copy of the Dirtree can be
-// made in a different goroutine. The paths processed are written to the channel prog.
+// made in a different goroutine. The progress of the build is written to the channel prog.
 // The Filesystem fs is used for opening files.
-func BuildFs(fs Filesystem, basepath string, opts *BuildOpts) (ops chan OpData, prog chan string) {
+func BuildFs(fs Filesystem, basepath string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
 
 	ops = make(chan OpData)
-	prog = make(chan string)
+	prog = make(chan Progress)
 
 	go build(fs, basepath, ops, prog, opts)
 
 	return
 }
 
+// BuildFsContext is like BuildFs, but stops when ctx is done in the same way as BuildContext.
+func BuildFsContext(ctx context.Context, fs Filesystem, basepath string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+
+	ops = make(chan OpData)
+	prog = make(chan Progress)
+
+	go buildContext(ctx, fs, basepath, ops, prog, opts)
+
+	return
+}
+
 // BuildSync builds a new Dirtree starting from the specified directory `basepath` and returns it when
 // it's complete.
 func BuildSync(basepath string, opts *BuildOpts) *Dirtree {
@@ -99,7 +288,399 @@ func BuildSync(basepath string, opts *BuildOpts) *Dirtree {
 	return tree
 }
 
-func build(fs Filesystem, basepath string, ops chan OpData, prog chan string, opts *BuildOpts) {
+// dirListing is the result of reading a single directory during a build.
+type dirListing struct {
+	path string
+	// Push operations for the entries of the directory that should be added to the tree.
+	entries    []OpData
+	size       int64
+	allocSize  int64
+	sharedSize int64
+	// Number of entries of each kind that are not in entries.
+	files, dirs, other int64
+	// Range of times of the entries that are not in entries.
+	times Times
+	// Types of the files that are not in entries.
+	types TypeHistogram
+	// Owners of the files that are not in entries.
+	users, groups OwnerHistogram
+	// Files whose allocated size differs a lot from their apparent size.
+	sparse []*SparseFile
+	// Last image layer that contributed to the files that are not in entries.
+	layer    int
+	accurate bool
+	errors   []*ScanError
+	// Inodes and stamps of the directories in entries, if known. Indexed the same as entries.
+	inodes []inode
+	stamps []dirStamp
+	// stamp of the directory itself, if known.
+	stamp dirStamp
+	// prev is the node for the directory in the previous tree of an incremental build,
+	// if the entries of the node can be used instead of reading the directory.
+	prev *Node
+	// Files in the directory with more than one hard link. Their sizes are not
+	// yet counted in size or entries.
+	links []hardLink
+	// readFiles and readBytes count the files found so far while the directory is read, for the progress
+	// reports made before it's done. They are updated atomically.
+	readFiles, readBytes int64
+	// onBatch, if it's not nil, is called by the goroutine that reads the directory after each batch of entries.
+	onBatch func()
+	// done is closed once the fields above are filled in.
+	done chan struct{}
+}
+
+// inode identifies a file independently of the paths that link to it.
+type inode struct {
+	dev, ino uint64
+}
+
+// hardLink is a file found while reading a directory that has more than one hard link.
+type hardLink struct {
+	inode
+	size, allocSize int64
+	// typ is the type of the file, if files are grouped by type.
+	typ string
+	// owner of the file, if owners are recorded.
+	owner fileOwner
+	// Index of the file's Push operation in entries, or -1 if files are not included.
+	entry int
+}
+
+func newDirListing(path string) *dirListing {
+	return &dirListing{path: path, done: make(chan struct{})}
+}
+
+// fileSizes returns the apparent and allocated sizes of the file fi that are counted in the SizeMode m.
+func fileSizes(fi os.FileInfo, m SizeMode) (size, allocSize int64) {
+	if m != SizeModeAllocated {
+		size = fi.Size()
+	}
+
+	if m == SizeModeAllocated || m == SizeModeBoth {
+		if a, ok := fi.(allocSizer); ok {
+			allocSize = a.AllocSize()
+			return
+		}
+
+		var err error
+		allocSize, err = sh.GetAllocatedSize(fi)
+		if err != nil {
+			allocSize = fi.Size()
+		}
+	}
+	return
+}
+
+// dirReader holds the state needed to read directories during a build. It's
+// used concurrently by the build workers so it must not be modified after it's created.
+type dirReader struct {
+	fs               Filesystem
+	opts             *BuildOpts
+	basepath         string
+	baseDevId        uint64
+	include, exclude []*Pattern
+	// throttle paces the reads, if it's not nil.
+	throttle *throttle
+	// mounts finds the mount points, if the mount table is known.
+	mounts *mountTable
+	// statDirs is true if the directories found need to be looked up, for their device, inode or times.
+	// Otherwise the type in the directory entry is enough, and the times of the directories are those of
+	// the files in them.
+	statDirs bool
+}
+
+func newDirReader(fs Filesystem, opts *BuildOpts, basepath string, baseDevId uint64) *dirReader {
+	return &dirReader{
+		fs:        fs,
+		opts:      opts,
+		basepath:  basepath,
+		baseDevId: baseDevId,
+		include:   compileValidPatterns(opts.Include),
+		exclude:   compileValidPatterns(opts.Exclude),
+		mounts:    newMountTable(fs, opts, basepath),
+		statDirs:  opts.OneFs || opts.FollowSymlinks != SymlinksNever || opts.Previous != nil || opts.AccessTimes,
+	}
+}
+
+// compileValidPatterns compiles the patterns in s, skipping any that are invalid.
+func compileValidPatterns(s []string) []*Pattern {
+	var pats []*Pattern
+	for _, v := range s {
+		if p, err := CompilePattern(v); err == nil {
+			pats = append(pats, p)
+		}
+	}
+	return pats
+}
+
+// skip returns true if the path should be left out of the build.
+func (r *dirReader) skip(fpath string, isDir bool) bool {
+	if len(r.exclude) == 0 && len(r.include) == 0 {
+		return false
+	}
+
+	// The patterns are matched against the path relative to the root of the tree.
+	if rel, err := filepath.Rel(r.basepath, fpath); err == nil {
+		fpath = rel
+	}
+	if matchAny(r.exclude, fpath, isDir) {
+		return true
+	}
+	return !isDir && len(r.include) > 0 && !matchAny(r.include, fpath, isDir)
+}
+
+// followTarget returns information about the target of the symbolic link fpath in the directory dir
+// if the link should be followed. Otherwise it returns nil.
+func (r *dirReader) followTarget(dir, fpath string) os.FileInfo {
+	sfs, ok := r.fs.(StatFilesystem)
+	if !ok {
+		return nil
+	}
+
+	switch r.opts.FollowSymlinks {
+	case SymlinksNever:
+		return nil
+	case SymlinksTopLevel:
+		if dir != r.basepath {
+			return nil
+		}
+	}
+
+	r.throttle.stat()
+	fi, err := sfs.Stat(fpath)
+	if err != nil {
+		// Broken links are left as links.
+		return nil
+	}
+	return fi
+}
+
+// entryTimes returns the times of the single entry fi.
+func (r *dirReader) entryTimes(fi os.FileInfo) Times {
+	t := Times{NewestMtime: fi.ModTime(), OldestMtime: fi.ModTime()}
+	if r.opts.AccessTimes {
+		if atime, err := sh.GetAccessTime(fi); err == nil {
+			t.NewestAtime, t.OldestAtime = atime, atime
+		}
+	}
+	return t
+}
+
+// addEntry adds the Push operation op for an entry of the directory to l. The entry is described by fi,
+// if it was looked up.
+func (l *dirListing) addEntry(op OpData, fi os.FileInfo) {
+	var in inode
+	var stamp dirStamp
+	if fi != nil && (op.Type == PathTypeDir || op.Type == PathTypeSymlinkDir) {
+		if dev, ino, _, err := sh.GetLinkInfo(fi); err == nil {
+			in = inode{dev, ino}
+		}
+		stamp = newDirStamp(fi)
+	}
+
+	l.entries = append(l.entries, op)
+	l.inodes = append(l.inodes, in)
+	l.stamps = append(l.stamps, stamp)
+}
+
+// readDirBatch is the maximum number of directory entries read at once.
+var readDirBatch = 1024
+
+// readDir reads the directory for the listing l and closes l.done.
+func (r *dirReader) readDir(l *dirListing) {
+	defer close(l.done)
+
+	if l.prev != nil {
+		r.reuseDir(l)
+		return
+	}
+
+	r.throttle.dir()
+	dir, err := r.fs.Open(l.path)
+	if err != nil {
+		l.errors = append(l.errors, newScanError(l.path, err))
+		return
+	}
+	defer dir.Close()
+
+	l.accurate = true
+
+	for {
+		start := time.Now()
+		des, err := dir.ReadDir(readDirBatch)
+		r.throttle.readLatency(time.Since(start))
+
+		for _, de := range des {
+			r.addDirEntry(l, de)
+		}
+		if l.onBatch != nil {
+			l.onBatch()
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			l.errors = append(l.errors, newScanError(l.path, err))
+			l.accurate = false
+			break
+		}
+		if len(des) == 0 {
+			break
+		}
+	}
+}
+
+// addDirEntry adds the directory entry de to the listing l.
+func (r *dirReader) addDirEntry(l *dirListing, de iofs.DirEntry) {
+	opts := r.opts
+	fpath := l.path + string(os.PathSeparator) + de.Name()
+
+	symlink := de.Type()&os.ModeSymlink != 0
+
+	// The type is enough to decide if most excluded entries are skipped, which
+	// avoids an lstat for them.
+	if !symlink && r.skip(fpath, de.IsDir()) {
+		return
+	}
+
+	// Other directories are only looked up if an option needs it.
+	var fi os.FileInfo
+	if symlink || !de.IsDir() || r.statDirs {
+		r.throttle.stat()
+		var err error
+		fi, err = de.Info()
+		if err != nil {
+			l.errors = append(l.errors, newScanError(fpath, err))
+			l.accurate = false
+			return
+		}
+	}
+
+	if symlink {
+		if target := r.followTarget(l.path, fpath); target != nil {
+			fi = target
+		}
+	}
+
+	if fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+		// A link that is not followed.
+		if r.skip(fpath, false) {
+			return
+		}
+		times := r.entryTimes(fi)
+		if opts.IncludeFiles {
+			l.addEntry(OpData{Op: Push, Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: PathTypeSymlink, Other: 1, Times: times}, fi)
+		} else {
+			l.other++
+			l.times.merge(&times)
+		}
+		return
+	}
+
+	if symlink && r.skip(fpath, fi.IsDir()) {
+		return
+	}
+
+	var times Times
+	if fi != nil {
+		times = r.entryTimes(fi)
+	}
+
+	if fi == nil {
+		r.addDir(l, fpath, fi, false, times)
+	} else if fi.Mode().IsRegular() {
+		size, allocSize := fileSizes(fi, opts.SizeMode)
+		ftype := FileType(fpath, opts.FileTypes)
+		owner := r.owner(fi)
+		if s := r.sparseFile(fpath, fi); s != nil {
+			l.sparse = append(l.sparse, s)
+		}
+		atomic.AddInt64(&l.readFiles, 1)
+		atomic.AddInt64(&l.readBytes, progressBytes(opts.SizeMode, size, allocSize))
+
+		var link *hardLink
+		if opts.HardLinks != HardLinksCountAll {
+			dev, ino, nlink, err := sh.GetLinkInfo(fi)
+			if err == nil && nlink > 1 {
+				link = &hardLink{inode: inode{dev, ino}, size: size, allocSize: allocSize, typ: ftype, owner: owner, entry: -1}
+			}
+		}
+
+		if opts.IncludeFiles {
+			if link != nil {
+				link.entry = len(l.entries)
+			}
+			typ := PathTypeFile
+			if symlink {
+				typ = PathTypeSymlink
+			}
+			l.addEntry(OpData{Op: Push, Size: size, AllocSize: allocSize, Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: typ, Files: 1, Layer: fileLayer(fi),
+				Times: times}, fi)
+		} else {
+			l.files++
+			l.times.merge(&times)
+			if layer := fileLayer(fi); layer > l.layer {
+				l.layer = layer
+			}
+			if link == nil {
+				l.size += size
+				l.allocSize += allocSize
+			}
+		}
+
+		// The types and owners are only counted in the directory, even for the files in entries, to
+		// save a histogram for each file.
+		if link == nil {
+			l.types = l.types.add(ftype, TypeTotals{size, allocSize, 1})
+			owner.addTo(&l.users, &l.groups, TypeTotals{size, allocSize, 1})
+		}
+
+		if link != nil {
+			l.links = append(l.links, *link)
+		}
+	} else if fi.IsDir() {
+		r.addDir(l, fpath, fi, symlink, times)
+	} else {
+		l.other++
+		l.times.merge(&times)
+	}
+}
+
+// addDir adds the directory fpath, described by fi if it was looked up, to the listing l. If symlink
+// is true, fpath is a symbolic link to the directory.
+func (r *dirReader) addDir(l *dirListing, fpath string, fi os.FileInfo, symlink bool, times Times) {
+	if fstype, skip := r.skipMount(fpath, fi); skip {
+		// Mount points that are not read are kept as leaves, so that it's clear they were left out.
+		l.addEntry(OpData{Op: Push, Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: PathTypeMount, FsType: fstype, Times: times}, fi)
+		return
+	}
+
+	typ := PathTypeDir
+	if symlink {
+		typ = PathTypeSymlinkDir
+	}
+	l.addEntry(OpData{Op: Push, Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: typ, Times: times}, fi)
+}
+
+// deviceId returns the device of the directory fpath described by fi. The device is taken from fi
+// if possible, so that the directory doesn't need to be looked up again.
+func (r *dirReader) deviceId(fpath string, fi os.FileInfo) (uint64, error) {
+	if dev, _, _, err := sh.GetLinkInfo(fi); err == nil {
+		return dev, nil
+	}
+	return r.fs.DeviceId(fpath)
+}
+
+func build(fs Filesystem, basepath string, ops chan OpData, prog chan Progress, opts *BuildOpts) {
+	buildContext(context.Background(), fs, basepath, ops, prog, opts)
+}
+
+// incompleteTimeout is how long a cancelled build waits for the Incomplete operation to be read.
+var incompleteTimeout = time.Second
+
+func buildContext(ctx context.Context, fs Filesystem, basepath string, ops chan OpData, prog chan Progress, opts *BuildOpts) {
 
 	if ops != nil {
 		defer close(ops)
@@ -109,105 +690,301 @@ func build(fs Filesystem, basepath string, ops chan OpData, prog chan string, op
 		defer close(prog)
 	}
 
-	if ops != nil {
-		ops <- OpData{Op: Push, Path: basepath, Basename: filepath.Base(basepath), SizeAccurate: true}
+	// send writes op to ops. It returns false if the build was cancelled before op could be written.
+	send := func(op OpData) bool {
+		select {
+		case ops <- op:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	counter := newProgressCounter(opts.SizeMode)
+	sendProg := func(p Progress) {
+		if prog != nil {
+			select {
+			case prog <- p:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	defer func() {
+		if ctx.Err() == nil {
+			return
+		}
+
+		// The consumer may have stopped reading, so don't wait forever.
+		t := time.NewTimer(incompleteTimeout)
+		select {
+		case ops <- OpData{Op: Incomplete}:
+		case <-t.C:
+		}
+		t.Stop()
+	}()
+
+	if !send(OpData{Op: Push, Path: basepath, Basename: filepath.Base(basepath), SizeAccurate: true}) {
+		return
 	}
 
-	// Directories to process
-	work := make([]string, 0, 1000)
+	// Directories to process. The order in which directories are taken from work
+	// must match the order in which ApplyCtx pops nodes, so the listings are always
+	// consumed from this goroutine even when they are read by workers.
+	work := make([]*dirListing, 0, 1000)
 
 	baseDevId, err := fs.DeviceId(basepath)
 	if opts.OneFs && err != nil {
 		return
 	}
 
-	work = append(work, basepath)
+	// The root of the tree, which differs from basepath when a directory under it is read again.
+	root := basepath
+	if opts.Root != "" {
+		root = opts.Root
+	}
 
-	ticker := time.NewTicker(300 * time.Millisecond)
+	reader := newDirReader(fs, opts, root, baseDevId)
+	reader.throttle = newThrottle(opts.Throttle, ctx.Done())
 
-	procDir := func(path string) {
-		accurate := true
+	// Directories to be read by the worker pool, if any.
+	var jobs chan *dirListing
+	if opts.Workers > 1 {
+		jobs = make(chan *dirListing, opts.Workers)
+		defer close(jobs)
 
-		dir, err := fs.Open(path)
-		if err != nil {
-			//fmt.Println("Error opening directory", path, ":", err)
-			ops <- OpData{Op: AddSize, Size: 0, SizeAccurate: false}
-			return
+		for i := 0; i < opts.Workers; i++ {
+			go func() {
+				lockIOPriority(opts.Throttle)
+				for l := range jobs {
+					reader.readDir(l)
+				}
+			}()
 		}
+	} else {
+		// Directories are read from this goroutine, which always runs on its own.
+		lockIOPriority(opts.Throttle)
+	}
 
-		fis, err := dir.Readdir(-1)
-		if err != nil {
-			//fmt.Println("Error processing directory", path)
-			accurate = false
+	// Directories of the previous tree, by path, for an incremental build.
+	prev := newPrevIndex(fs, opts)
+
+	addWork := func(path string, stamp dirStamp) bool {
+		l := newDirListing(path)
+		l.stamp = stamp
+		l.prev = prev.reusable(path, stamp)
+		if jobs != nil {
+			select {
+			case jobs <- l:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		work = append(work, l)
+		return true
+	}
+
+	addWork(basepath, prev.stamp(basepath))
+
+	// Inodes of hard linked files that have already been counted, and the listing for the
+	// PathTypeShared node. The shared listing is the first work added, so that it is the last processed.
+	seen := make(map[inode]bool)
+	var shared *dirListing
+
+	// Inodes of the directories added to the build, used to avoid following symbolic links in loops.
+	dirs := make(map[inode]bool)
+	if sfs, ok := fs.(StatFilesystem); ok && opts.FollowSymlinks != SymlinksNever {
+		if fi, err := sfs.Stat(basepath); err == nil {
+			if dev, ino, _, err := sh.GetLinkInfo(fi); err == nil {
+				dirs[inode{dev, ino}] = true
+			}
+		}
+	}
+
+	// followDir decides whether the directory entry i in l is traversed, and records
+	// its inode. It returns false for links to directories that were already added.
+	followDir := func(l *dirListing, i int) bool {
+		in := l.inodes[i]
+		if opts.FollowSymlinks == SymlinksNever || in == (inode{}) {
+			return true
 		}
 
-		size := int64(0)
-		for _, fi := range fis {
-			fpath := path + string(os.PathSeparator) + fi.Name()
+		if l.entries[i].Type == PathTypeSymlinkDir && dirs[in] {
+			l.entries[i].Type = PathTypeSymlink
+			l.entries[i].Other = 1
+			return false
+		}
+		dirs[in] = true
+		return true
+	}
 
-			if fi.Mode().IsRegular() {
-				if opts.IncludeFiles {
-					ops <- OpData{Op: Push, Size: fi.Size(), Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: PathTypeFile}
-					//ops <- OpData{Op: AddSize, Size: fi.Size(), SizeAccurate: true}
-				} else {
-					size += fi.Size()
+	// countLinks decides which of the hard linked files in l are counted, and updates the
+	// sizes of l accordingly.
+	countLinks := func(l *dirListing) {
+		for _, link := range l.links {
+			counted := false
+			if !seen[link.inode] {
+				seen[link.inode] = true
+				// In a build of a directory under the root there is no shared node, and the size is left to
+				// the shared node of the root.
+				if opts.HardLinks != HardLinksShared {
+					counted = true
+				} else if shared != nil {
+					shared.size += link.size
+					shared.allocSize += link.allocSize
+					shared.sharedSize += link.size
+					shared.types = shared.types.add(link.typ, TypeTotals{Size: link.size, AllocSize: link.allocSize})
+					link.owner.addTo(&shared.users, &shared.groups, TypeTotals{Size: link.size, AllocSize: link.allocSize})
 				}
-			} else if fi.IsDir() {
+			}
 
-				if opts.OneFs {
-					devId, err := fs.DeviceId(fpath)
+			t := TypeTotals{Files: 1}
+			if counted {
+				t.Size, t.AllocSize = link.size, link.allocSize
+			}
+			l.types = l.types.add(link.typ, t)
+			link.owner.addTo(&l.users, &l.groups, t)
+
+			if link.entry >= 0 {
+				op := &l.entries[link.entry]
+				op.SharedSize = link.size
+				if !counted {
+					op.Size, op.AllocSize = 0, 0
+				}
+			} else {
+				l.sharedSize += link.size
+				if counted {
+					l.size += link.size
+					l.allocSize += link.allocSize
+				}
+			}
+		}
+	}
 
-					if err == nil && baseDevId != devId {
-						continue
-					}
+	ticker := time.NewTicker(300 * time.Millisecond)
+
+	// procDir writes the operations for the directory listing l. It returns false if the build was cancelled.
+	procDir := func(l *dirListing) bool {
+		if l == shared {
+			counter.counts.Bytes += counter.bytes(l.size, l.allocSize)
+			return send(OpData{Op: AddSize, Size: l.size, AllocSize: l.allocSize, SharedSize: l.sharedSize, Types: l.types,
+				Users: l.users, Groups: l.groups, SizeAccurate: true})
+		}
+
+		if jobs == nil {
+			// The directory is read from this goroutine, so the progress is reported between the batches of entries.
+			l.onBatch = func() {
+				select {
+				case <-ticker.C:
+					sendProg(counter.reading(l))
+				default:
 				}
+			}
+			reader.readDir(l)
+		}
 
-				ops <- OpData{Op: Push, Path: fpath, Basename: filepath.Base(fpath), SizeAccurate: true, Type: PathTypeDir}
-				work = append(work, fpath)
+		// Large directories take a while to read, so the progress of the read is reported in the meantime.
+		for reading := true; reading; {
+			select {
+			case <-l.done:
+				reading = false
+			case <-ticker.C:
+				sendProg(counter.reading(l))
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if opts.HardLinks == HardLinksShared && shared == nil && root == basepath {
+			shared = newDirListing(basepath + string(os.PathSeparator) + SharedBasename)
+			if !send(OpData{Op: Push, Path: shared.path, Basename: SharedBasename, SizeAccurate: true, Type: PathTypeShared}) {
+				return false
+			}
+			work = append(work, shared)
+		}
+
+		countLinks(l)
+		counter.listing(l)
+
+		// The directories are recorded before the links to directories, so that a link to a
+		// sibling is not followed, whichever comes first.
+		follow := make([]bool, len(l.entries))
+		for _, links := range []bool{false, true} {
+			for i := range l.entries {
+				if typ := l.entries[i].Type; typ.isDirLike() && (typ == PathTypeSymlinkDir) == links {
+					follow[i] = followDir(l, i)
+				}
+			}
+		}
+
+		for i := range l.entries {
+			op := l.entries[i]
+			if op.Type == PathTypeSymlink && !opts.IncludeFiles {
+				// A link to a directory that was already added, which is counted like the other links when
+				// files are excluded.
+				l.other++
+				l.times.merge(&op.Times)
+				continue
+			}
+			if !send(op) {
+				return false
+			}
+			if follow[i] {
+				l.dirs++
+				if !addWork(op.Path, l.stamps[i]) {
+					return false
+				}
 			}
 
 			// Send a progress update if this is taking a long time
 			select {
 			case <-ticker.C:
-				if prog != nil {
-					prog <- fpath
-				}
+				sendProg(counter.report(op.Path))
 			default:
 			}
 		}
 
-		dir.Close()
+		for _, e := range l.errors {
+			if !send(OpData{Op: Error, Path: e.Path, Err: e}) {
+				return false
+			}
+		}
 
-		ops <- OpData{Op: AddSize, Size: size, SizeAccurate: accurate}
+		return send(OpData{Op: AddSize, Size: l.size, AllocSize: l.allocSize, SharedSize: l.sharedSize, Files: l.files, Dirs: l.dirs, Other: l.other, Layer: l.layer, Types: l.types, Users: l.users, Groups: l.groups, Sparse: l.sparse, Times: l.times, SizeAccurate: l.accurate,
+			ModTime: l.stamp.modTime, ChangeTime: l.stamp.changeTime})
 	}
 
 	for len(work) > 0 {
 		// Refactor below; use the same code as in Apply.
-		path := work[len(work)-1]
+		l := work[len(work)-1]
 		work = work[0 : len(work)-1]
 
-		ops <- OpData{Op: Pop}
-
-		procDir(path)
-
-		if prog != nil {
-			prog <- path
+		if !send(OpData{Op: Pop}) || !procDir(l) {
+			break
 		}
+
+		sendProg(counter.report(l.path))
 	}
 
 	ticker.Stop()
 }
 
-// Same as Apply, but a copy of each OpData in ops is written to outops
+// Same as Apply, but a copy of each OpData in ops is written to outops. outops is closed once all
+// the operations have been applied to t.
 func ApplyAndDup(t *Dirtree, ops chan OpData, outops chan OpData) {
 	applyOps := make(chan OpData)
-	go t.ApplyAll(applyOps)
+	applied := make(chan struct{})
+	go func() {
+		t.ApplyAll(applyOps)
+		close(applied)
+	}()
 
-	defer close(applyOps)
 	defer close(outops)
 
 	for op := range ops {
 		applyOps <- op
 		outops <- op
 	}
+	close(applyOps)
+	<-applied
 }
@@ -1,8 +1,12 @@
 package dirtree
 
 import (
-	"errors"
+	"context"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -11,6 +15,13 @@ type TestFileInfo struct {
 	name string
 	size int64
 	mode os.FileMode
+	// Number of 512-byte blocks allocated, inode number, number of hard links and owner.
+	// If all are zero, Sys returns nil.
+	blocks     int64
+	ino, nlink uint64
+	uid, gid   uint32
+	// Modification time. If zero, ModTime returns the current time.
+	mtime time.Time
 }
 
 func (t TestFileInfo) Name() string {
@@ -26,7 +37,10 @@ func (t TestFileInfo) Mode() os.FileMode {
 }
 
 func (t TestFileInfo) ModTime() time.Time {
-	return time.Now()
+	if t.mtime.IsZero() {
+		return time.Now()
+	}
+	return t.mtime
 }
 
 func (t TestFileInfo) IsDir() bool {
@@ -34,7 +48,10 @@ func (t TestFileInfo) IsDir() bool {
 }
 
 func (t TestFileInfo) Sys() interface{} {
-	return nil
+	if t.blocks == 0 && t.ino == 0 && t.nlink == 0 && t.uid == 0 && t.gid == 0 {
+		return nil
+	}
+	return &syscall.Stat_t{Blocks: t.blocks, Ino: t.ino, Nlink: t.nlink, Uid: t.uid, Gid: t.gid}
 }
 
 func NewTestFileInfo(name string, dir bool, size int64) TestFileInfo {
@@ -63,24 +80,73 @@ func (t TestFile) Readdir(count int) ([]os.FileInfo, error) {
 	return []os.FileInfo(t), nil
 }
 
+// TestDir is an open TestFile. It reads the entries in batches like os.File.ReadDir.
+type TestDir struct {
+	TestFile
+	pos int
+	// Number of calls to ReadDir.
+	reads int
+	// readAll is true if ReadDir was asked for all the entries at once.
+	readAll bool
+}
+
+func (t *TestDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	t.reads++
+	if count <= 0 {
+		t.readAll = true
+	}
+
+	n := len(t.TestFile) - t.pos
+	if count > 0 && n > count {
+		n = count
+	}
+	if n == 0 && count > 0 {
+		return nil, io.EOF
+	}
+
+	des := make([]fs.DirEntry, n)
+	for i := range des {
+		des[i] = fs.FileInfoToDirEntry(t.TestFile[t.pos+i])
+	}
+	t.pos += n
+	return des, nil
+}
+
 type TestFs struct {
 	// Map a path to the file.
 	Files map[string]TestFile
+	// Map a path to the information returned by Stat. Paths that are not in Targets
+	// are looked up in the directory in Files that contains them.
+	Targets map[string]os.FileInfo
 }
 
 func (t TestFs) Open(name string) (file File, err error) {
 	f, ok := t.Files[name]
 	if !ok {
-		return nil, errors.New("No such file " + name)
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 	}
 
-	return f, nil
+	return &TestDir{TestFile: f}, nil
 }
 
 func (t TestFs) DeviceId(path string) (id uint64, err error) {
 	return 0, nil
 }
 
+func (t TestFs) Stat(path string) (os.FileInfo, error) {
+	if fi, ok := t.Targets[path]; ok {
+		return fi, nil
+	}
+
+	for _, fi := range t.Files[filepath.Dir(path)] {
+		if fi.Name() == filepath.Base(path) {
+			return fi, nil
+		}
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
 func makeTestFs() TestFs {
 	/*
 	  "/tmp"
@@ -167,3 +233,529 @@ func TestBuild(t *testing.T) {
 	}
 
 }
+
+func TestBuildWorkers(t *testing.T) {
+	fs := makeTestFs()
+
+	sizes := func(workers int) map[string]int64 {
+		opts := *DefaultBuildOpts
+		opts.Workers = workers
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+
+		tree := New()
+		tree.ApplyAll(ops)
+
+		m := map[string]int64{}
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			m[n.Info.Path] = n.Info.Size
+			return true, false
+		}, 0)
+		return m
+	}
+
+	expected := sizes(1)
+	if len(expected) != 4 {
+		t.Fatal("Expected 4 directories in the tree but found", len(expected))
+	}
+
+	for _, workers := range []int{2, 4, 16} {
+		got := sizes(workers)
+		if len(got) != len(expected) {
+			t.Fatal("With", workers, "workers the tree has", len(got), "directories but should have", len(expected))
+		}
+		for path, size := range expected {
+			if got[path] != size {
+				t.Fatal("With", workers, "workers directory", path, "should have size", size, "but has size", got[path])
+			}
+		}
+	}
+}
+
+func TestBuildSizeMode(t *testing.T) {
+	sparse := NewTestFileInfo("sparse.img", false, 100000)
+	sparse.blocks = 8
+	small := NewTestFileInfo("small.txt", false, 10)
+	small.blocks = 8
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp": TestFile{sparse, small, NewTestFileInfo("nostat", false, 30)},
+		},
+	}
+
+	tests := []struct {
+		mode            SizeMode
+		size, allocSize int64
+	}{
+		{SizeModeApparent, 100040, 0},
+		{SizeModeAllocated, 0, 8222},
+		{SizeModeBoth, 100040, 8222},
+	}
+
+	for _, tc := range tests {
+		opts := *DefaultBuildOpts
+		opts.SizeMode = tc.mode
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+
+		tree := New()
+		tree.ApplyAll(ops)
+
+		if tree.Root.Info.Size != tc.size {
+			t.Fatal("In mode", tc.mode, "root should have size", tc.size, "but has size", tree.Root.Info.Size)
+		}
+		if tree.Root.Info.AllocSize != tc.allocSize {
+			t.Fatal("In mode", tc.mode, "root should have allocated size", tc.allocSize, "but has allocated size", tree.Root.Info.AllocSize)
+		}
+	}
+}
+
+func TestBuildHardLinks(t *testing.T) {
+	link := func(name string) TestFileInfo {
+		fi := NewTestFileInfo(name, false, 100)
+		fi.ino = 5
+		fi.nlink = 2
+		return fi
+	}
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp":   TestFile{NewTestFileInfo("a", true, 0), NewTestFileInfo("b", true, 0)},
+			"/tmp/a": TestFile{link("x"), NewTestFileInfo("z", false, 10)},
+			"/tmp/b": TestFile{link("y")},
+		},
+	}
+
+	tests := []struct {
+		mode       HardLinkMode
+		rootSize   int64
+		sharedNode int64
+	}{
+		{HardLinksCountAll, 210, -1},
+		{HardLinksFirstPath, 110, -1},
+		{HardLinksShared, 110, 100},
+	}
+
+	for _, tc := range tests {
+		for _, includeFiles := range []bool{false, true} {
+			opts := *DefaultBuildOpts
+			opts.HardLinks = tc.mode
+			opts.IncludeFiles = includeFiles
+
+			ops := make(chan OpData)
+			go build(fs, "/tmp", ops, nil, &opts)
+
+			tree := New()
+			tree.ApplyAll(ops)
+
+			if tree.Root.Info.Size != tc.rootSize {
+				t.Fatal("In mode", tc.mode, "root should have size", tc.rootSize, "but has size", tree.Root.Info.Size)
+			}
+
+			shared := childWithBasename(tree.Root, SharedBasename)
+			if tc.sharedNode < 0 {
+				if shared != nil {
+					t.Fatal("In mode", tc.mode, "there should be no", SharedBasename, "node")
+				}
+			} else {
+				if shared == nil || shared.Info.Type != PathTypeShared {
+					t.Fatal("In mode", tc.mode, "there should be a", SharedBasename, "node")
+				}
+				if shared.Info.Size != tc.sharedNode {
+					t.Fatal("In mode", tc.mode, "shared node should have size", tc.sharedNode, "but has size", shared.Info.Size)
+				}
+			}
+
+			if tc.mode != HardLinksCountAll {
+				a := childWithBasename(tree.Root, "a")
+				b := childWithBasename(tree.Root, "b")
+				if a.Info.SharedSize != 100 || b.Info.SharedSize != 100 {
+					t.Fatal("In mode", tc.mode, "a and b should share 100 bytes but share", a.Info.SharedSize, "and", b.Info.SharedSize)
+				}
+			}
+		}
+	}
+}
+
+func TestBuildContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ops, prog := BuildFsContext(ctx, makeTestFs(), "/tmp", DefaultBuildOpts)
+	go func() {
+		for _ = range prog {
+		}
+	}()
+
+	tree := New()
+	// Push of the root, Pop, and the Pushes of the root's children.
+	for i := 0; i < 4; i++ {
+		tree.Apply(<-ops)
+	}
+
+	cancel()
+
+	var last OpData
+	for op := range ops {
+		tree.Apply(op)
+		last = op
+	}
+
+	if last.Op != Incomplete {
+		t.Fatal("The last operation of a cancelled build should be Incomplete but was", last.Op)
+	}
+
+	if tree.Root.Info.SizeAccurate {
+		t.Fatal("The root of a cancelled build should not be accurate")
+	}
+}
+
+func TestBuildContextCancelNoReader(t *testing.T) {
+	saved := incompleteTimeout
+	incompleteTimeout = 10 * time.Millisecond
+	defer func() { incompleteTimeout = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ops := make(chan OpData)
+	done := make(chan struct{})
+	go func() {
+		buildContext(ctx, makeTestFs(), "/tmp", ops, nil, DefaultBuildOpts)
+		close(done)
+	}()
+
+	<-ops
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A cancelled build should stop even if the operations are not read")
+	}
+
+	if _, ok := <-ops; ok {
+		t.Fatal("The operations channel should be closed")
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	fs := makeTestFs()
+	delete(fs.Files, "/tmp/b/dir")
+
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, DefaultBuildOpts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+
+	dir := childWithBasename(childWithBasename(tree.Root, "b"), "dir")
+	if dir == nil {
+		t.Fatal("Directory dir should be in the tree")
+	}
+
+	if len(dir.Info.Errors) != 1 {
+		t.Fatal("Directory dir should have one error but has", len(dir.Info.Errors))
+	}
+
+	e := dir.Info.Errors[0]
+	if e.Path != "/tmp/b/dir" || e.Kind != ErrorVanished {
+		t.Fatal("Directory dir has the wrong error:", e)
+	}
+
+	if dir.Info.SizeAccurate || tree.Root.Info.SizeAccurate {
+		t.Fatal("Directory dir and its ancestors should be inaccurate")
+	}
+
+	if a := childWithBasename(tree.Root, "a"); !a.Info.SizeAccurate || len(a.Info.Errors) != 0 {
+		t.Fatal("Directory a should be accurate and have no errors")
+	}
+}
+
+func TestBuildErrorsRefresh(t *testing.T) {
+	fs := makeTestFs()
+	delete(fs.Files, "/tmp/b/dir")
+
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, DefaultBuildOpts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+
+	// Reading the directory again replaces its errors rather than adding to them.
+	dir := childWithBasename(childWithBasename(tree.Root, "b"), "dir")
+	for i := 0; i < 3; i++ {
+		dir.UpdateSize(0, 0, true)
+		dir.DelAll()
+
+		ops := make(chan OpData)
+		go build(fs, dir.Info.Path, ops, nil, DefaultBuildOpts)
+		ctx := NewApplyContext(dir)
+		for op := range ops {
+			tree.ApplyCtx(ctx, op)
+		}
+
+		if len(dir.Info.Errors) != 1 {
+			t.Fatal("After reading it again", i+1, "times, directory dir should have one error but has", len(dir.Info.Errors))
+		}
+	}
+}
+
+func TestBuildSymlinks(t *testing.T) {
+	info := func(name string, mode os.FileMode, size int64, ino uint64) TestFileInfo {
+		return TestFileInfo{name: name, mode: mode, size: size, ino: ino}
+	}
+
+	/*
+	  /tmp
+	  /tmp/a/file1.txt        20
+	  /tmp/ext -> /data
+	  /tmp/ext/data.bin        7
+	  /tmp/ext/deeper -> /more
+	  /tmp/ext/deeper/x        3
+	  /tmp/a/loop -> /tmp
+	*/
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp":            TestFile{info("a", os.ModeDir, 0, 2), info("ext", os.ModeSymlink, 5, 3)},
+			"/tmp/a":          TestFile{info("file1.txt", 0, 20, 4), info("loop", os.ModeSymlink, 4, 5)},
+			"/tmp/ext":        TestFile{info("data.bin", 0, 7, 11), info("deeper", os.ModeSymlink, 5, 12)},
+			"/tmp/ext/deeper": TestFile{info("x", 0, 3, 21)},
+		},
+		Targets: map[string]os.FileInfo{
+			"/tmp":            info("tmp", os.ModeDir, 0, 1),
+			"/tmp/a/loop":     info("loop", os.ModeDir, 0, 1),
+			"/tmp/ext":        info("ext", os.ModeDir, 0, 10),
+			"/tmp/ext/deeper": info("deeper", os.ModeDir, 0, 20),
+		},
+	}
+
+	tests := []struct {
+		mode     SymlinkMode
+		rootSize int64
+		types    map[string]PathType
+	}{
+		{SymlinksNever, 20, map[string]PathType{"ext": PathTypeSymlink, "loop": PathTypeSymlink}},
+		{SymlinksTopLevel, 27, map[string]PathType{"ext": PathTypeSymlinkDir, "deeper": PathTypeSymlink, "loop": PathTypeSymlink}},
+		{SymlinksAlways, 30, map[string]PathType{"ext": PathTypeSymlinkDir, "deeper": PathTypeSymlinkDir, "loop": PathTypeSymlink}},
+	}
+
+	for _, tc := range tests {
+		opts := *DefaultBuildOpts
+		opts.FollowSymlinks = tc.mode
+		opts.IncludeFiles = true
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+
+		tree := New()
+		tree.ApplyAll(ops)
+
+		if tree.Root.Info.Size != tc.rootSize {
+			t.Fatal("In mode", tc.mode, "root should have size", tc.rootSize, "but has size", tree.Root.Info.Size)
+		}
+
+		found := map[string]PathType{}
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			found[n.Info.Basename] = n.Info.Type
+			return true, false
+		}, 0)
+
+		for name, typ := range tc.types {
+			if got, ok := found[name]; !ok || got != typ {
+				t.Fatal("In mode", tc.mode, name, "should have type", typ, "but has type", got, "(present:", ok, ")")
+			}
+		}
+	}
+}
+
+func TestBuildSymlinkSibling(t *testing.T) {
+	link := TestFileInfo{name: "link", mode: os.ModeSymlink, size: 5, ino: 3}
+	dir := TestFileInfo{name: "z", mode: os.ModeDir, ino: 2}
+
+	// The link to z is not followed, whether it's listed before z or after it. Without files, it's
+	// counted in the directory rather than added as an entry.
+	for _, includeFiles := range []bool{false, true} {
+		for _, entries := range []TestFile{{link, dir}, {dir, link}} {
+			fs := TestFs{
+				Files: map[string]TestFile{
+					"/tmp":   entries,
+					"/tmp/z": TestFile{NewTestFileInfo("file", false, 10)},
+				},
+				Targets: map[string]os.FileInfo{
+					"/tmp":      TestFileInfo{name: "tmp", mode: os.ModeDir, ino: 1},
+					"/tmp/link": dir,
+				},
+			}
+
+			opts := *DefaultBuildOpts
+			opts.FollowSymlinks = SymlinksAlways
+			opts.IncludeFiles = includeFiles
+			tree := buildIncrementalTree(fs, &opts)
+
+			if tree.Root.Info.Size != 10 {
+				t.Fatal("With entries", entries[0].Name(), "first, z should be counted once, so the root should have size 10 but has", tree.Root.Info.Size)
+			}
+			n := childWithBasename(tree.Root, "link")
+			if includeFiles && (n == nil || n.Info.Type != PathTypeSymlink) {
+				t.Fatal("With entries", entries[0].Name(), "first, the link should not be followed but is", n)
+			}
+			if !includeFiles && (n != nil || tree.Root.Info.Other != 1) {
+				t.Fatal("With entries", entries[0].Name(), "first and no files, the link should be counted in the root but is", n)
+			}
+		}
+	}
+}
+
+func TestBuildCounts(t *testing.T) {
+	fs := makeTestFs()
+	fs.Files["/tmp/b"] = append(fs.Files["/tmp/b"], TestFileInfo{name: "fifo", mode: os.ModeNamedPipe})
+
+	expected := map[string][3]int64{
+		"tmp": {4, 3, 1},
+		"a":   {2, 0, 0},
+		"b":   {2, 1, 1},
+		"dir": {1, 0, 0},
+	}
+
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+
+		tree := New()
+		tree.ApplyAll(ops)
+
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			if n.Info.Type != PathTypeDir {
+				return true, false
+			}
+			counts := [3]int64{n.Info.Files, n.Info.Dirs, n.Info.Other}
+			if counts != expected[n.Info.Basename] {
+				t.Fatal("Directory", n.Info.Basename, "should have file, dir and other counts", expected[n.Info.Basename], "but has", counts)
+			}
+			return true, false
+		}, 0)
+
+		if tree.Root.Info.SizeIn(SizeModeEntries) != 8 {
+			t.Fatal("Root should have 8 entries but has", tree.Root.Info.SizeIn(SizeModeEntries))
+		}
+	}
+}
+
+func TestBuildTimes(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	info := func(name string, dir bool, mtime time.Time) TestFileInfo {
+		fi := NewTestFileInfo(name, dir, 1)
+		fi.mtime = mtime
+		return fi
+	}
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp":     TestFile{info("old", true, day(2)), info("new", true, day(3)), info("f", false, day(5))},
+			"/tmp/old": TestFile{info("a", false, day(1)), info("b", false, day(4))},
+			"/tmp/new": TestFile{info("c", false, day(20))},
+		},
+	}
+
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+
+		tree := New()
+		tree.SortChildren = true
+		tree.ApplyAll(ops)
+
+		check := func(n *Node, oldestDay, newestDay int) {
+			if !n.Info.OldestMtime.Equal(day(oldestDay)) || !n.Info.NewestMtime.Equal(day(newestDay)) {
+				t.Fatal("Node", n.Info.Path, "should have times from day", oldestDay, "to", newestDay, "but has", n.Info.OldestMtime, "to", n.Info.NewestMtime)
+			}
+		}
+
+		check(tree.Root, 1, 20)
+		check(childWithBasename(tree.Root, "old"), 1, 4)
+		check(childWithBasename(tree.Root, "new"), 3, 20)
+
+		tree.SetSizeMode(SizeModeStaleness)
+		if tree.Root.Children[0].Info.Basename != "old" {
+			t.Fatal("The stalest directory should be sorted first, but the first is", tree.Root.Children[0].Info.Basename)
+		}
+	}
+}
+
+func TestBuildBatches(t *testing.T) {
+	defer func(n int) { readDirBatch = n }(readDirBatch)
+
+	expected := map[string]int64{"tmp": 65, "a": 30, "b": 35, "dir": 30}
+
+	for _, batch := range []int{1, 2, 1024} {
+		readDirBatch = batch
+
+		ops := make(chan OpData)
+		go build(makeTestFs(), "/tmp", ops, nil, DefaultBuildOpts)
+
+		tree := New()
+		tree.ApplyAll(ops)
+
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			if n.Info.Size != expected[n.Info.Basename] {
+				t.Fatal("With batches of", batch, "directory", n.Info.Basename, "should have size", expected[n.Info.Basename], "but has", n.Info.Size)
+			}
+			if !n.Info.SizeAccurate {
+				t.Fatal("With batches of", batch, "directory", n.Info.Basename, "should have an accurate size")
+			}
+			return true, false
+		}, 0)
+	}
+
+	// A directory larger than a batch is read in several batches.
+	readDirBatch = 2
+	fs := openedFs{TestFs{Files: map[string]TestFile{"/tmp": TestFile{
+		NewTestFileInfo("1", false, 1),
+		NewTestFileInfo("2", false, 1),
+		NewTestFileInfo("3", false, 1),
+		NewTestFileInfo("4", false, 1),
+		NewTestFileInfo("5", false, 1),
+	}}}, make(map[string]*TestDir)}
+
+	opts := *DefaultBuildOpts
+	opts.Workers = 1
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, &opts)
+	tree := New()
+	tree.ApplyAll(ops)
+
+	if tree.Root.Info.Size != 5 {
+		t.Fatal("The root should have size 5 but has", tree.Root.Info.Size)
+	}
+	dir := fs.opened["/tmp"]
+	if dir.reads < 3 {
+		t.Fatal("The 5 entries should be read in at least 3 batches of 2, but were read in", dir.reads)
+	}
+	if dir.readAll {
+		t.Fatal("The entries should not be read all at once")
+	}
+}
+
+// openedFs is a TestFs that keeps the directories opened, by path.
+type openedFs struct {
+	TestFs
+	opened map[string]*TestDir
+}
+
+func (f openedFs) Open(name string) (File, error) {
+	file, err := f.TestFs.Open(name)
+	if err == nil {
+		f.opened[name] = file.(*TestDir)
+	}
+	return file, err
+}
@@ -0,0 +1,172 @@
+package dirtree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiffKind describes how a path changed between two trees.
+type DiffKind uint8
+
+const (
+	// DiffSame means the size of the path did not change, although entries under it may have.
+	DiffSame DiffKind = iota
+	DiffAdded
+	DiffRemoved
+	DiffGrown
+	DiffShrunk
+)
+
+var diffKindNames = []string{"same", "added", "removed", "grown", "shrunk"}
+
+func (k DiffKind) String() string {
+	if int(k) < len(diffKindNames) {
+		return diffKindNames[k]
+	}
+	return fmt.Sprintf("DiffKind(%d)", k)
+}
+
+// DiffNode is a node of the tree of changes returned by Diff.
+type DiffNode struct {
+	Parent   *DiffNode
+	Children []*DiffNode
+	Path     string
+	Basename string
+	Type     PathType
+	Kind     DiffKind
+	// Old and New are the nodes that were compared. Old is nil for an added path and New is nil for a removed one.
+	Old, New *Node
+	// SizeDelta, AllocSizeDelta and EntriesDelta are the changes in the apparent size, allocated size and
+	// number of entries at or under the path.
+	SizeDelta, AllocSizeDelta, EntriesDelta int64
+}
+
+// Diff compares the trees old and new, which were built from the same path at different times, and returns
+// a tree of the changes. Paths are matched by name. The tree holds the root, and the paths that were added,
+// removed or changed in size or number of entries. The children of each node are sorted from the largest
+// growth to the largest shrinkage. It returns nil if both trees are empty.
+func Diff(old, new *Dirtree) *DiffNode {
+	if old.Root == nil && new.Root == nil {
+		return nil
+	}
+	return diffNodes(nil, old.Root, new.Root)
+}
+
+func diffNodes(parent *DiffNode, o, n *Node) *DiffNode {
+	d := &DiffNode{Parent: parent, Old: o, New: n}
+
+	var oi, ni PathInfo
+	if o != nil {
+		oi = o.Info
+	}
+	if n != nil {
+		ni = n.Info
+	}
+
+	info := &ni
+	switch {
+	case o == nil:
+		d.Kind = DiffAdded
+	case n == nil:
+		d.Kind = DiffRemoved
+		info = &oi
+	}
+	d.Path, d.Basename, d.Type = info.Path, info.Basename, info.Type
+
+	d.SizeDelta = ni.Size - oi.Size
+	d.AllocSizeDelta = ni.AllocSize - oi.AllocSize
+	d.EntriesDelta = ni.Entries() - oi.Entries()
+
+	if o != nil && n != nil {
+		delta := d.SizeDelta
+		if delta == 0 {
+			delta = d.AllocSizeDelta
+		}
+		switch {
+		case delta > 0:
+			d.Kind = DiffGrown
+		case delta < 0:
+			d.Kind = DiffShrunk
+		}
+	}
+
+	olds := make(map[string]*Node)
+	if o != nil {
+		for _, c := range o.Children {
+			olds[c.Info.Basename] = c
+		}
+	}
+
+	add := func(c *DiffNode) {
+		if c.changed() {
+			d.Children = append(d.Children, c)
+		}
+	}
+
+	if n != nil {
+		for _, c := range n.Children {
+			oc := olds[c.Info.Basename]
+			delete(olds, c.Info.Basename)
+
+			if oc != nil && oc.Info.Type.isDirLike() != c.Info.Type.isDirLike() {
+				// A file replaced by a directory, or the other way around.
+				add(diffNodes(d, oc, nil))
+				oc = nil
+			}
+			add(diffNodes(d, oc, c))
+		}
+	}
+	for _, oc := range olds {
+		add(diffNodes(d, oc, nil))
+	}
+
+	sort.Slice(d.Children, func(i, j int) bool {
+		a, b := d.Children[i], d.Children[j]
+		if a.SizeDelta != b.SizeDelta {
+			return a.SizeDelta > b.SizeDelta
+		}
+		return strings.Compare(a.Basename, b.Basename) < 0
+	})
+
+	return d
+}
+
+// changed returns true if the node should be in the tree of changes.
+func (d *DiffNode) changed() bool {
+	return d.Kind != DiffSame || d.AllocSizeDelta != 0 || d.EntriesDelta != 0 || len(d.Children) > 0
+}
+
+// OwnSizeDelta returns the part of SizeDelta that's not in the children of d; that is, the change
+// in the size of the entries of the directory that are not nodes of their own.
+func (d *DiffNode) OwnSizeDelta() int64 {
+	delta := d.SizeDelta
+	for _, c := range d.Children {
+		delta -= c.SizeDelta
+	}
+	return delta
+}
+
+// TopGrowers returns up to n nodes at or under d whose own size grew the most, as returned by OwnSizeDelta,
+// from the most growth to the least. Only nodes that grew are returned.
+func (d *DiffNode) TopGrowers(n int) []*DiffNode {
+	var growers []*DiffNode
+	var walk func(d *DiffNode)
+	walk = func(d *DiffNode) {
+		if d.OwnSizeDelta() > 0 {
+			growers = append(growers, d)
+		}
+		for _, c := range d.Children {
+			walk(c)
+		}
+	}
+	walk(d)
+
+	sort.SliceStable(growers, func(i, j int) bool {
+		return growers[i].OwnSizeDelta() > growers[j].OwnSizeDelta()
+	})
+	if len(growers) > n {
+		growers = growers[:n]
+	}
+	return growers
+}
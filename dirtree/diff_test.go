@@ -0,0 +1,69 @@
+package dirtree
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+		old := buildIncrementalTree(makeTestFs(), &opts)
+
+		// A file grows by 1000 bytes, /tmp/b/dir is removed and /tmp/c is added.
+		fs := makeTestFs()
+		fs.Files["/tmp"] = append(fs.Files["/tmp"], NewTestFileInfo("c", true, 0))
+		fs.Files["/tmp/a"][0] = NewTestFileInfo("file1.txt", false, 1020)
+		fs.Files["/tmp/b"] = fs.Files["/tmp/b"][:1]
+		delete(fs.Files, "/tmp/b/dir")
+		fs.Files["/tmp/c"] = TestFile{NewTestFileInfo("x", false, 7)}
+		new := buildIncrementalTree(fs, &opts)
+
+		d := Diff(old, new)
+		if d.SizeDelta != 977 || d.Kind != DiffGrown {
+			t.Fatal("With files", includeFiles, "the root should have grown by 977 bytes, but changed by", d.SizeDelta, "and is", d.Kind)
+		}
+
+		expected := []struct {
+			name  string
+			kind  DiffKind
+			delta int64
+		}{{"a", DiffGrown, 1000}, {"c", DiffAdded, 7}, {"b", DiffShrunk, -30}}
+		if len(d.Children) != len(expected) {
+			t.Fatal("With files", includeFiles, "the root should have", len(expected), "changed children but has", len(d.Children))
+		}
+		for i, e := range expected {
+			c := d.Children[i]
+			if c.Basename != e.name || c.Kind != e.kind || c.SizeDelta != e.delta {
+				t.Fatal("With files", includeFiles, "child", i, "should be", e, "but is", c.Basename, c.Kind, c.SizeDelta)
+			}
+		}
+
+		b := d.Children[2]
+		if len(b.Children) != 1 || b.Children[0].Basename != "dir" || b.Children[0].Kind != DiffRemoved || b.Children[0].New != nil {
+			t.Fatal("With files", includeFiles, "/tmp/b/dir should be removed")
+		}
+
+		growers := d.TopGrowers(10)
+		names := []string{"a", "c"}
+		if includeFiles {
+			names = []string{"file1.txt", "x"}
+		}
+		if len(growers) != len(names) {
+			t.Fatal("With files", includeFiles, "there should be", len(names), "growers but there are", len(growers))
+		}
+		for i, name := range names {
+			if growers[i].Basename != name {
+				t.Fatal("With files", includeFiles, "grower", i, "should be", name, "but is", growers[i].Basename)
+			}
+		}
+	}
+}
+
+func TestDiffSame(t *testing.T) {
+	opts := *DefaultBuildOpts
+	d := Diff(buildIncrementalTree(makeTestFs(), &opts), buildIncrementalTree(makeTestFs(), &opts))
+	if d.Kind != DiffSame || len(d.Children) != 0 || len(d.TopGrowers(10)) != 0 {
+		t.Fatal("Identical trees should have no changes")
+	}
+}
@@ -1,16 +1,227 @@
 package dirtree
 
+import (
+	"fmt"
+	"math"
+	"time"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
 type PathType uint8
 
 const (
 	PathTypeDir PathType = iota
 	PathTypeFile
+	// PathTypeShared is a synthetic node that holds the size of files with several hard links
+	// when the build uses HardLinksShared.
+	PathTypeShared
+	// PathTypeSymlink is a symbolic link that was not followed, or a followed link to a file.
+	PathTypeSymlink
+	// PathTypeSymlinkDir is a followed symbolic link to a directory.
+	PathTypeSymlinkDir
+	// PathTypeMulti is the synthetic root of a tree built by BuildMulti, whose children are the roots.
+	PathTypeMulti
+	// PathTypeMount is a mount point that was not read, because it's on another filesystem or of a
+	// type that is not allowed.
+	PathTypeMount
+)
+
+// isDirLike returns true if nodes of the type are popped and sized like directories
+// when operations are applied.
+func (t PathType) isDirLike() bool {
+	return t == PathTypeDir || t == PathTypeShared || t == PathTypeSymlinkDir || t == PathTypeMulti
+}
+
+// SizeMode selects which measure of size is used for paths.
+type SizeMode uint8
+
+const (
+	// SizeModeApparent uses the size of the file contents, as reported by ls.
+	SizeModeApparent SizeMode = iota
+	// SizeModeAllocated uses the space allocated on disk for the file, as reported by du.
+	SizeModeAllocated
+	// SizeModeBoth uses both sizes. Where only one size can be used, the apparent size is chosen.
+	SizeModeBoth
+	// SizeModeEntries uses the number of files, directories and other entries, as reported by
+	// du --inodes. When building, only the apparent size is computed.
+	SizeModeEntries
+	// SizeModeStaleness uses the time since anything at or under the path was modified.
+	// Children are sorted from stalest to freshest. When building, only the apparent size is computed.
+	SizeModeStaleness
 )
 
+var sizeModeNames = []string{"apparent", "allocated", "both", "entries", "staleness"}
+
+func (m SizeMode) String() string {
+	if int(m) < len(sizeModeNames) {
+		return sizeModeNames[m]
+	}
+	return fmt.Sprintf("SizeMode(%d)", m)
+}
+
+// ParseSizeMode returns the SizeMode with the name s, as returned by SizeMode.String.
+func ParseSizeMode(s string) (SizeMode, error) {
+	for i, v := range sizeModeNames {
+		if v == s {
+			return SizeMode(i), nil
+		}
+	}
+	return SizeModeApparent, fmt.Errorf("Unknown size mode '%s'. Must be one of apparent, allocated, both, entries or staleness", s)
+}
+
+// Times holds the range of modification and access times of a path and the entries under it.
+// Zero times are unknown. Access times are only recorded if the build was asked to.
+type Times struct {
+	NewestMtime, OldestMtime time.Time
+	NewestAtime, OldestAtime time.Time
+}
+
+// merge widens the ranges of times in t to include the times in o.
+func (t *Times) merge(o *Times) {
+	t.NewestMtime = newest(t.NewestMtime, o.NewestMtime)
+	t.OldestMtime = oldest(t.OldestMtime, o.OldestMtime)
+	t.NewestAtime = newest(t.NewestAtime, o.NewestAtime)
+	t.OldestAtime = oldest(t.OldestAtime, o.OldestAtime)
+}
+
+func newest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func oldest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
 type PathInfo struct {
-	Path         string
-	Basename     string
-	Size         int64
-	SizeAccurate bool
-	Type         PathType
+	Path     string
+	Basename string
+	// Size is the apparent size of the path.
+	Size int64
+	// AllocSize is the size allocated on disk for the path.
+	AllocSize int64
+	// SharedSize is the apparent size of the files under the path that have more than one hard link.
+	SharedSize int64
+	// Files, Dirs and Other are the number of regular files, directories and other entries
+	// at or under the path. A directory does not count itself.
+	Files, Dirs, Other int64
+	SizeAccurate       bool
+	Type               PathType
+	// Errors are the errors that occurred reading the path or its entries. Errors in
+	// descendants are only reflected in SizeAccurate.
+	Errors []*ScanError
+	// Layer is the one-based index of the last container image layer that contributed bytes to
+	// the path, or zero if the path is not in an image. Like the times, it's not lowered when
+	// entries are removed.
+	Layer int
+	// ModTime and ChangeTime are the modification and status change times of a directory itself when its
+	// entries were read. They are zero if the directory was not read completely. Incremental builds
+	// use them to find the directories that changed.
+	ModTime, ChangeTime time.Time
+	// Types holds the totals of the files under a directory by type, if the build grouped them with
+	// BuildOpts.FileTypes. The nodes for files don't have them, so like the times they are not lowered
+	// when files are removed.
+	Types TypeHistogram
+	// Users and Groups hold the totals of the files under a directory by the user and group that
+	// own them, if the build recorded owners with BuildOpts.Owners. Like Types, the nodes for files
+	// don't have them.
+	Users, Groups OwnerHistogram
+	// Sparse lists the files in a directory whose allocated size differs a lot from their apparent size, if
+	// the build looked for them with BuildOpts.Sparse. Like Errors, it only holds the directory's own entries.
+	Sparse []*SparseFile
+	// FsType is the type of the filesystem mounted at a node of type PathTypeMount, if it's known.
+	FsType string
+	// Times of the path and the entries under it. They are not narrowed when entries are removed.
+	Times
+}
+
+// SizeIn returns the size of the path measured using the SizeMode m.
+func (p *PathInfo) SizeIn(m SizeMode) int64 {
+	switch m {
+	case SizeModeAllocated:
+		return p.AllocSize
+	case SizeModeEntries:
+		return p.Entries()
+	case SizeModeStaleness:
+		if p.NewestMtime.IsZero() {
+			return 0
+		}
+		return int64(time.Since(p.NewestMtime).Seconds())
+	}
+	return p.Size
+}
+
+// sortKey returns the value that nodes are sorted by, from largest to smallest, in the SizeMode m.
+func (p *PathInfo) sortKey(m SizeMode) int64 {
+	if m == SizeModeStaleness {
+		// Sort by time rather than age so that the order doesn't change during a sort.
+		if p.NewestMtime.IsZero() {
+			return math.MinInt64
+		}
+		return -p.NewestMtime.Unix()
+	}
+	return p.SizeIn(m)
+}
+
+// Entries returns the total number of entries at or under the path.
+func (p *PathInfo) Entries() int64 {
+	return p.Files + p.Dirs + p.Other
+}
+
+// FormatSize returns the size of the path measured using the SizeMode m, formatted for display.
+func (p *PathInfo) FormatSize(m SizeMode) string {
+	switch m {
+	case SizeModeBoth:
+		return sh.FancySize(p.Size) + "/" + sh.FancySize(p.AllocSize)
+	case SizeModeEntries:
+		return fmt.Sprintf("%d entries", p.Entries())
+	case SizeModeStaleness:
+		if p.NewestMtime.IsZero() {
+			return "never modified"
+		}
+		return fmt.Sprintf("modified %d days ago", p.SizeIn(m)/(24*60*60))
+	}
+	return sh.FancySize(p.SizeIn(m))
+}
+
+// addTotals adds the sizes, types and owners in d to those of p, and merges the times in d into p.
+func (p *PathInfo) addTotals(d *PathInfo) {
+	p.Size += d.Size
+	p.AllocSize += d.AllocSize
+	p.SharedSize += d.SharedSize
+	p.Files += d.Files
+	p.Dirs += d.Dirs
+	p.Other += d.Other
+	if len(d.Types) > 0 {
+		p.Types = p.Types.merge(d.Types)
+	}
+	if len(d.Users) > 0 || len(d.Groups) > 0 {
+		p.Users = p.Users.merge(d.Users)
+		p.Groups = p.Groups.merge(d.Groups)
+	}
+	if d.Layer > p.Layer {
+		p.Layer = d.Layer
+	}
+	p.Times.merge(&d.Times)
+}
+
+// negTotals returns a PathInfo holding the negation of the sizes, types and owners of p. The times and layer are left zero.
+func (p *PathInfo) negTotals() *PathInfo {
+	return &PathInfo{
+		Size:       -p.Size,
+		AllocSize:  -p.AllocSize,
+		SharedSize: -p.SharedSize,
+		Files:      -p.Files,
+		Dirs:       -p.Dirs,
+		Other:      -p.Other,
+		Types:      p.Types.neg(),
+		Users:      p.Users.neg(),
+		Groups:     p.Groups.neg(),
+	}
 }
@@ -2,6 +2,7 @@ package dirtree
 
 import (
 	"log"
+	"os"
 	"sort"
 	"strings"
 
@@ -17,16 +18,19 @@ type Node struct {
 	UserData interface{}
 	// SortChildren specifies whether the children of this node should be sorted from biggest to smallest.
 	SortChildren bool
+	// SizeMode specifies which size of the children is compared when sorting, and which size
+	// is used when the node is treated as a TreeSizer.
+	SizeMode SizeMode
 }
 
 func (n *Node) sortChildren() {
 	if n.SortChildren {
 		sort.SliceStable(n.Children, func(i, j int) bool {
-			cmp := n.Children[i].Info.Size - n.Children[j].Info.Size
-			if cmp == 0 {
-				cmp = int64(strings.Compare(n.Children[j].Info.Basename, n.Children[i].Info.Basename))
+			ki, kj := n.Children[i].Info.sortKey(n.SizeMode), n.Children[j].Info.sortKey(n.SizeMode)
+			if ki != kj {
+				return ki > kj
 			}
-			return cmp > 0
+			return strings.Compare(n.Children[j].Info.Basename, n.Children[i].Info.Basename) > 0
 		})
 	}
 }
@@ -43,9 +47,10 @@ func (n *Node) add(child *Node, updateSize bool) {
 	n.Children = append(n.Children, child)
 	child.Parent = n
 	child.SortChildren = n.SortChildren
+	child.SizeMode = n.SizeMode
 	n.sortChildren()
 	if updateSize {
-		n.addSize(child.Info.Size, true)
+		n.addSize(&child.Info, true)
 	}
 }
 
@@ -76,7 +81,7 @@ func (n *Node) del(child *Node, updateSize bool) {
 			n.Children = n.Children[0 : len(n.Children)-1]
 
 			if updateSize {
-				n.addSize(-v.Info.Size, true)
+				n.addSize(v.Info.negTotals(), true)
 			}
 			break
 		}
@@ -84,20 +89,25 @@ func (n *Node) del(child *Node, updateSize bool) {
 	n.sortChildren()
 }
 
-// UpdateSize updates the size of the directory in the node, and updates the size of the ancestors as well.
-func (n *Node) UpdateSize(size int64, sizeAccurate bool) {
-	delta := size - n.Info.Size
+// UpdateSize updates the apparent and allocated sizes of the directory in the node, and updates the sizes of the ancestors as well.
+// The other totals of the node, such as the size of files shared through hard links and the number of entries, are reset to zero,
+// and the times and errors of the node are cleared.
+func (n *Node) UpdateSize(size, allocSize int64, sizeAccurate bool) {
+	delta := n.Info.negTotals()
+	delta.addTotals(&PathInfo{Size: size, AllocSize: allocSize})
 	n.addSize(delta, sizeAccurate)
+	n.Info.Times = Times{}
+	n.Info.Errors = nil
 }
 
-// Add size bytes to the size of this node and all ancestors.
-func (n *Node) addSize(size int64, sizeAccurate bool) {
-	n.Info.Size += size
+// Add the sizes in delta to the sizes of this node and all ancestors.
+func (n *Node) addSize(delta *PathInfo, sizeAccurate bool) {
+	n.Info.addTotals(delta)
 	if n.Info.SizeAccurate {
 		n.Info.SizeAccurate = sizeAccurate
 	}
 	if n.Parent != nil {
-		n.Parent.addSize(size, sizeAccurate)
+		n.Parent.addSize(delta, sizeAccurate)
 	}
 	n.sortChildren()
 }
@@ -140,7 +150,7 @@ func (n *Node) Walk(visitor Visitor, depth int) bool {
 
 // Needed to implement TreeSizer
 func (n *Node) Size() float64 {
-	return float64(n.Info.Size)
+	return float64(n.Info.SizeIn(n.SizeMode))
 }
 
 // Needed to implement TreeSizer
@@ -191,7 +201,13 @@ func (n *Node) Walk(visitor Visitor, depth int) {
 */
 type ApplyContext struct {
 	curNode *Node
-	work    []*Node
+	// curSized is true if an AddSize operation was applied to curNode since it was popped.
+	curSized bool
+	work     []*Node
+	// Fenced, if it's not nil, returns true for the nodes that the operations must not change, such as
+	// those under a directory that another build is reading again. The nodes pushed under a fenced node
+	// are not added to the tree.
+	Fenced func(n *Node) bool
 }
 
 func NewApplyContext(root *Node) *ApplyContext {
@@ -204,6 +220,8 @@ type Dirtree struct {
 	Root         *Node
 	applyCtx     *ApplyContext
 	SortChildren bool
+	// SizeMode is the size used to sort and measure the nodes of the tree.
+	SizeMode SizeMode
 }
 
 // New creates a new, empty Dirtree
@@ -220,8 +238,21 @@ func (t *Dirtree) Apply(op OpData) (added *Node) {
 }
 
 func (t *Dirtree) ApplyCtx(ctx *ApplyContext, op OpData) (added *Node) {
+	fenced := func(n *Node) bool {
+		return n != nil && ctx.Fenced != nil && ctx.Fenced(n)
+	}
+
 	push := func(op OpData) {
-		node := &Node{Info: PathInfo{Path: op.Path, Basename: op.Basename, SizeAccurate: true, Type: op.Type, Size: op.Size}}
+		node := &Node{Info: PathInfo{Path: op.Path, Basename: op.Basename, SizeAccurate: true, Type: op.Type, FsType: op.FsType}}
+		node.Info.addTotals(op.sizes())
+
+		if fenced(ctx.curNode) {
+			// The node is still pushed, so that the operations under it are applied to it rather than to the tree.
+			if op.Type.isDirLike() {
+				ctx.work = append(ctx.work, node)
+			}
+			return
+		}
 		added = node
 
 		log.Printf("Dirtree.ApplyCtx: push operation. Current Tree Node = %v. Operation data = %v\n", ctx.curNode, op)
@@ -236,6 +267,7 @@ func (t *Dirtree) ApplyCtx(ctx *ApplyContext, op OpData) (added *Node) {
 			if t.SortChildren {
 				t.Root.SortChildren = true
 			}
+			t.Root.SizeMode = t.SizeMode
 		} else {
 			if op.Path != ctx.curNode.Info.Path {
 				log.Printf("Dirtree.ApplyCtx: push operation: adding op under current node\n")
@@ -245,7 +277,7 @@ func (t *Dirtree) ApplyCtx(ctx *ApplyContext, op OpData) (added *Node) {
 			}
 		}
 
-		if op.Type != PathTypeFile {
+		if op.Type.isDirLike() {
 			ctx.work = append(ctx.work, node)
 		}
 	}
@@ -253,13 +285,46 @@ func (t *Dirtree) ApplyCtx(ctx *ApplyContext, op OpData) (added *Node) {
 	pop := func() {
 		ctx.curNode = ctx.work[len(ctx.work)-1]
 		ctx.work = ctx.work[0 : len(ctx.work)-1]
+		ctx.curSized = false
 		log.Printf("Dirtree.ApplyCtx: pop operation. Current Tree Node after = %v\n", ctx.curNode)
 	}
 
 	addSize := func(op OpData) {
 		log.Printf("Dirtree.ApplyCtx: addSize operation. Current Tree Node = %v. Operation data = %v\n", ctx.curNode, op)
-		size := ctx.curNode.Info.Size + op.Size
-		ctx.curNode.UpdateSize(size, op.SizeAccurate)
+		if fenced(ctx.curNode) {
+			return
+		}
+		ctx.curNode.addSize(op.sizes(), op.SizeAccurate)
+		if !op.ModTime.IsZero() {
+			ctx.curNode.Info.ModTime, ctx.curNode.Info.ChangeTime = op.ModTime, op.ChangeTime
+		}
+		// A directory is sized once when it's read, so this replaces the files found when it was last read.
+		ctx.curNode.Info.Sparse = op.Sparse
+		ctx.curSized = true
+	}
+
+	addError := func(op OpData) {
+		log.Printf("Dirtree.ApplyCtx: error operation. Current Tree Node = %v. Operation data = %v\n", ctx.curNode, op)
+		if fenced(ctx.curNode) {
+			return
+		}
+		if op.Err != nil {
+			ctx.curNode.Info.Errors = append(ctx.curNode.Info.Errors, op.Err)
+		}
+		ctx.curNode.addSize(&PathInfo{}, false)
+	}
+
+	incomplete := func() {
+		log.Printf("Dirtree.ApplyCtx: incomplete operation. Current Tree Node = %v\n", ctx.curNode)
+		if ctx.curNode != nil && !ctx.curSized && !fenced(ctx.curNode) {
+			ctx.curNode.addSize(&PathInfo{}, false)
+		}
+		for _, n := range ctx.work {
+			if !fenced(n) {
+				n.addSize(&PathInfo{}, false)
+			}
+		}
+		ctx.work = ctx.work[0:0]
 	}
 
 	switch op.Op {
@@ -269,10 +334,76 @@ func (t *Dirtree) ApplyCtx(ctx *ApplyContext, op OpData) (added *Node) {
 		pop()
 	case AddSize:
 		addSize(op)
+	case Incomplete:
+		incomplete()
+	case Error:
+		addError(op)
 	}
 	return
 }
 
+// SetSizeMode changes the size used to sort and measure the nodes of the tree.
+func (t *Dirtree) SetSizeMode(m SizeMode) {
+	t.SizeMode = m
+	if t.Root == nil {
+		return
+	}
+
+	t.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		n.SizeMode = m
+		n.sortChildren()
+		return true, false
+	}, 0)
+}
+
+// SetSortChildren changes whether the children of the nodes of the tree are sorted from biggest to smallest.
+func (t *Dirtree) SetSortChildren(sort bool) {
+	t.SortChildren = sort
+	if t.Root == nil {
+		return
+	}
+
+	t.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		n.SortChildren = sort
+		n.sortChildren()
+		return true, false
+	}, 0)
+}
+
+// Find returns the node for path, or nil if it's not in the tree. The path must start with the path of the
+// root, written the same way, or with the path of one of the roots if the tree was built by BuildMulti.
+func (t *Dirtree) Find(path string) *Node {
+	n := t.Root
+	if n == nil || path == n.Info.Path {
+		return n
+	}
+	if n.Info.Type == PathTypeMulti {
+		if n = t.BuildRoot(path); n == nil || path == n.Info.Path {
+			return n
+		}
+	}
+
+	sep := string(os.PathSeparator)
+	if !strings.HasPrefix(path, n.Info.Path+sep) {
+		return nil
+	}
+
+	for _, name := range strings.Split(path[len(n.Info.Path+sep):], sep) {
+		var next *Node
+		for _, c := range n.Children {
+			if c.Info.Basename == name {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
 func (t *Dirtree) ApplyAll(ops chan OpData) {
 	for op := range ops {
 		t.Apply(op)
@@ -181,3 +181,65 @@ func TestNodeDel(t *testing.T) {
 		t.Fatal("Deleting child didn't update root size correctly. Root size is ", p.Info.Size)
 	}
 }
+
+func TestSetSizeMode(t *testing.T) {
+	tree := New()
+	tree.SortChildren = true
+	tree.Apply(OpData{Op: Push, Path: "/", Basename: "/"})
+	tree.Apply(OpData{Op: Pop})
+	tree.Apply(OpData{Op: Push, Path: "/big", Basename: "big", Size: 100, AllocSize: 4, Type: PathTypeFile})
+	tree.Apply(OpData{Op: Push, Path: "/dense", Basename: "dense", Size: 10, AllocSize: 12, Type: PathTypeFile})
+
+	if tree.Root.Children[0].Info.Basename != "big" {
+		t.Fatal("Children should be sorted by apparent size")
+	}
+
+	tree.SetSizeMode(SizeModeAllocated)
+
+	if tree.Root.Children[0].Info.Basename != "dense" {
+		t.Fatal("Children should be sorted by allocated size")
+	}
+
+	if tree.Root.Size() != 16 {
+		t.Fatal("Root should have allocated size 16 but has", tree.Root.Size())
+	}
+}
+
+func TestApplyFenced(t *testing.T) {
+	ops := make(chan OpData)
+	go build(makeTestFs(), "/tmp", ops, nil, DefaultBuildOpts)
+
+	tree := New()
+	ctx := NewApplyContext(nil)
+	ctx.Fenced = func(n *Node) bool {
+		return n.Info.Path == "/tmp/b"
+	}
+	for op := range ops {
+		tree.ApplyCtx(ctx, op)
+	}
+
+	if tree.Root.Info.Size != 30 {
+		t.Fatal("The sizes under /tmp/b should not be applied, so the root should have size 30 but has", tree.Root.Info.Size)
+	}
+	b := childWithBasename(tree.Root, "b")
+	if b == nil || len(b.Children) != 0 || b.Info.Size != 0 {
+		t.Fatal("The fenced node /tmp/b should be added, but with no children or size, but is", b)
+	}
+}
+
+func TestApplyAndDup(t *testing.T) {
+	ops := make(chan OpData)
+	go build(makeTestFs(), "/tmp", ops, nil, DefaultBuildOpts)
+
+	tree := New()
+	outops := make(chan OpData)
+	go ApplyAndDup(tree, ops, outops)
+
+	dup := New()
+	dup.ApplyAll(outops)
+
+	// Once outops is closed, the tree has all the operations applied.
+	if tree.Root == nil || tree.Root.Info.Size != dup.Root.Info.Size {
+		t.Fatal("The tree should be complete when the duplicated operations end, with size", dup.Root.Info.Size, "but is", tree.Root)
+	}
+}
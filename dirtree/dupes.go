@@ -0,0 +1,256 @@
+package dirtree
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// DupOpts are the options for FindDuplicates.
+type DupOpts struct {
+	// MinSize is the size of the smallest files compared. Empty files are never compared.
+	MinSize int64
+	// BlockSize is the size of the blocks at the start and end of files that are hashed to
+	// tell files of the same size apart before their whole contents are hashed.
+	BlockSize int64
+	// Workers is the number of files read concurrently.
+	Workers int
+}
+
+var DefaultDupOpts = &DupOpts{
+	MinSize:   1,
+	BlockSize: 4096,
+	Workers:   runtime.NumCPU(),
+}
+
+// DuplicateGroup is a set of files with the same contents.
+type DuplicateGroup struct {
+	// Size of each of the files.
+	Size int64
+	// Files are the nodes of the files, in the order they are in the tree.
+	Files []*Node
+}
+
+// Reclaimable returns the number of bytes freed by removing all but one of the files.
+func (g *DuplicateGroup) Reclaimable() int64 {
+	return g.Size * int64(len(g.Files)-1)
+}
+
+// dupCandidate is a file that may have the same contents as others.
+type dupCandidate struct {
+	node *Node
+	// key identifies the contents of the file as far as they have been compared.
+	key string
+}
+
+// FindDuplicates finds the files with the same contents in the tree t, which must have been built with
+// IncludeFiles from the local filesystem. Files are grouped by size, then by a hash of their first and last
+// blocks, then by a hash of their whole contents. The groups are sorted from the most reclaimable bytes to
+// the least. Paths that are hard links to the same file are counted once, since removing one of them doesn't
+// free any space. Files that can't be read are left out, and the errors are returned in errs.
+func FindDuplicates(t *Dirtree, opts *DupOpts) (groups []*DuplicateGroup, errs []*ScanError) {
+	groups, errs, _ = FindDuplicatesContext(context.Background(), t, opts)
+	return
+}
+
+// FindDuplicatesContext is like FindDuplicates, but stops when ctx is done. In that case err is ctx.Err().
+// The tree must not be modified during the call.
+func FindDuplicatesContext(ctx context.Context, t *Dirtree, opts *DupOpts) (groups []*DuplicateGroup, errs []*ScanError, err error) {
+	if opts == nil {
+		opts = DefaultDupOpts
+	}
+	if t.Root == nil {
+		return
+	}
+
+	bySize := make(map[int64][]*dupCandidate)
+	t.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		if n.Info.Type == PathTypeFile && n.Info.Size > 0 && n.Info.Size >= opts.MinSize {
+			bySize[n.Info.Size] = append(bySize[n.Info.Size], &dupCandidate{node: n})
+		}
+		return true, false
+	}, 0)
+
+	var sets [][]*dupCandidate
+	for _, set := range bySize {
+		if set = distinctFiles(set, &errs); len(set) > 1 {
+			sets = append(sets, set)
+		}
+	}
+
+	partial := func(c *dupCandidate) (string, error) {
+		return hashFile(c.node.Info.Path, c.node.Info.Size, opts.BlockSize)
+	}
+	whole := func(c *dupCandidate) (string, error) {
+		return hashFile(c.node.Info.Path, c.node.Info.Size, 0)
+	}
+
+	sets = refineDups(ctx, sets, partial, opts.Workers, &errs)
+
+	// The partial hash of small files covers their whole contents.
+	var large [][]*dupCandidate
+	for _, set := range sets {
+		if set[0].node.Info.Size > 2*opts.BlockSize {
+			large = append(large, set)
+		} else {
+			groups = append(groups, newDuplicateGroup(set))
+		}
+	}
+	for _, set := range refineDups(ctx, large, whole, opts.Workers, &errs) {
+		groups = append(groups, newDuplicateGroup(set))
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, errs, err
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		ri, rj := groups[i].Reclaimable(), groups[j].Reclaimable()
+		if ri != rj {
+			return ri > rj
+		}
+		return strings.Compare(groups[i].Files[0].Info.Path, groups[j].Files[0].Info.Path) < 0
+	})
+	return
+}
+
+func newDuplicateGroup(set []*dupCandidate) *DuplicateGroup {
+	g := &DuplicateGroup{Size: set[0].node.Info.Size}
+	for _, c := range set {
+		g.Files = append(g.Files, c.node)
+	}
+	return g
+}
+
+// distinctFiles returns the candidates in set that are not hard links to a file earlier in set, and that
+// still have the size recorded in the tree.
+func distinctFiles(set []*dupCandidate, errs *[]*ScanError) []*dupCandidate {
+	if len(set) < 2 {
+		return nil
+	}
+
+	seen := make(map[inode]bool)
+	var distinct []*dupCandidate
+	for _, c := range set {
+		fi, err := os.Lstat(c.node.Info.Path)
+		if err != nil {
+			*errs = append(*errs, newScanError(c.node.Info.Path, err))
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Size() != c.node.Info.Size {
+			continue
+		}
+		if dev, ino, _, err := sh.GetLinkInfo(fi); err == nil {
+			if seen[inode{dev, ino}] {
+				continue
+			}
+			seen[inode{dev, ino}] = true
+		}
+		distinct = append(distinct, c)
+	}
+	return distinct
+}
+
+// refineDups splits each of the sets of candidates by the hash computed by hash, which is added to
+// their keys, and returns the new sets that hold more than one candidate.
+func refineDups(ctx context.Context, sets [][]*dupCandidate, hash func(c *dupCandidate) (string, error), workers int, errs *[]*ScanError) [][]*dupCandidate {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var all []*dupCandidate
+	for _, set := range sets {
+		all = append(all, set...)
+	}
+
+	jobs := make(chan *dupCandidate)
+	failed := make([]error, len(all))
+	index := make(map[*dupCandidate]int, len(all))
+	for i, c := range all {
+		index[c] = i
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				h, err := hash(c)
+				if err != nil {
+					failed[index[c]] = err
+					continue
+				}
+				c.key += h
+			}
+		}()
+	}
+
+	for _, c := range all {
+		select {
+		case jobs <- c:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var refined [][]*dupCandidate
+	for _, set := range sets {
+		byKey := make(map[string][]*dupCandidate)
+		var keys []string
+		for _, c := range set {
+			if err := failed[index[c]]; err != nil {
+				*errs = append(*errs, newScanError(c.node.Info.Path, err))
+				continue
+			}
+			if byKey[c.key] == nil {
+				keys = append(keys, c.key)
+			}
+			byKey[c.key] = append(byKey[c.key], c)
+		}
+		for _, k := range keys {
+			if len(byKey[k]) > 1 {
+				refined = append(refined, byKey[k])
+			}
+		}
+	}
+	return refined
+}
+
+// hashFile returns the hash of the file path of the given size. If blockSize is not zero, only the first
+// and last blockSize bytes are hashed.
+func hashFile(path string, size, blockSize int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if blockSize == 0 || size <= 2*blockSize {
+		_, err = io.Copy(h, f)
+	} else {
+		if _, err = io.Copy(h, io.NewSectionReader(f, 0, blockSize)); err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(f, size-blockSize, blockSize))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
@@ -0,0 +1,67 @@
+package dirtree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 100)
+	write("a/x", big)
+	write("b/x", big)
+	write("c/y", big)
+	// The same size, start and end as big, but different in the middle.
+	other := append([]byte{}, big...)
+	other[500] = 'X'
+	write("d/z", other)
+	write("p1", []byte("small file"))
+	write("p2", []byte("small file"))
+	write("empty1", nil)
+	write("empty2", nil)
+	if err := os.Link(filepath.Join(dir, "a/x"), filepath.Join(dir, "e")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := *DefaultBuildOpts
+	opts.IncludeFiles = true
+	opts.HardLinks = HardLinksCountAll
+	tree := BuildSync(dir, &opts)
+
+	groups, errs := FindDuplicates(tree, &DupOpts{MinSize: 1, BlockSize: 16, Workers: 2})
+	if len(errs) != 0 {
+		t.Fatal("There should be no errors but there are", errs)
+	}
+	if len(groups) != 2 {
+		t.Fatal("There should be 2 groups of duplicates but there are", len(groups))
+	}
+
+	g := groups[0]
+	if len(g.Files) != 3 || g.Size != 1000 || g.Reclaimable() != 2000 {
+		t.Fatal("The first group should have 3 files of 1000 bytes but has", len(g.Files), "of", g.Size)
+	}
+	names := map[string]bool{}
+	for _, n := range g.Files {
+		names[n.Info.Path[len(dir):]] = true
+	}
+	if names["/d/z"] || (names["/a/x"] && names["/e"]) {
+		t.Fatal("The first group has the wrong files:", names)
+	}
+
+	g = groups[1]
+	if len(g.Files) != 2 || g.Size != 10 || g.Reclaimable() != 10 {
+		t.Fatal("The second group should have 2 files of 10 bytes but has", len(g.Files), "of", g.Size)
+	}
+}
@@ -0,0 +1,57 @@
+package dirtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrorKind classifies an error that occurred while reading a path during a build.
+type ErrorKind uint8
+
+const (
+	ErrorOther ErrorKind = iota
+	// ErrorPermission means the path could not be read because access was denied.
+	ErrorPermission
+	// ErrorVanished means the path was removed while the build was running.
+	ErrorVanished
+	// ErrorIO means the device returned an I/O error.
+	ErrorIO
+)
+
+var errorKindNames = []string{"error", "permission denied", "vanished", "I/O error"}
+
+func (k ErrorKind) String() string {
+	if int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return fmt.Sprintf("ErrorKind(%d)", k)
+}
+
+// ScanError describes an error that occurred while reading a path during a build.
+type ScanError struct {
+	Path string
+	Kind ErrorKind
+	// Msg is the text of the underlying error.
+	Msg string
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Kind, e.Msg)
+}
+
+// newScanError returns a ScanError for the error err that occurred while reading path.
+func newScanError(path string, err error) *ScanError {
+	kind := ErrorOther
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrorPermission
+	case errors.Is(err, os.ErrNotExist):
+		kind = ErrorVanished
+	case errors.Is(err, syscall.EIO):
+		kind = ErrorIO
+	}
+
+	return &ScanError{Path: path, Kind: kind, Msg: err.Error()}
+}
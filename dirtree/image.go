@@ -0,0 +1,338 @@
+package dirtree
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ImageFs is a Filesystem that presents the contents of a container image as a directory tree. It
+// reads an OCI image layout directory, or a tarball written by docker save.
+//
+// The layers of the image are applied in order, so the tree is the filesystem a container would start
+// with. The FileInfo of each file records the layer its contents came from, which builds store in
+// the Layer of the nodes. The sizes are measured in the same way as for a tar ArchiveFs.
+type ImageFs struct {
+	*ArchiveFs
+	// The contents of each layer on its own.
+	layers []*ArchiveFs
+}
+
+const (
+	// whiteoutPrefix starts the names of files in a layer that remove a path of the layers below.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque is the name of a file in a layer that hides the entries of the layers below in its directory.
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Layers returns the number of layers in the image.
+func (m *ImageFs) Layers() int {
+	return len(m.layers)
+}
+
+// Layer returns a Filesystem that holds only the files in the layer with the one-based index i, including
+// those that are removed or replaced by later layers. It has the same root as the image.
+func (m *ImageFs) Layer(i int) *ArchiveFs {
+	return m.layers[i-1]
+}
+
+// imageSource reads the files of an image layout, either from a directory or a tarball.
+type imageSource interface {
+	open(name string) (io.ReadCloser, error)
+}
+
+type dirImageSource string
+
+func (d dirImageSource) open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// tarImageSource reads files from a tarball without unpacking it, using the offsets of the files in it.
+type tarImageSource struct {
+	f     *os.File
+	files map[string]tarMember
+}
+
+type tarMember struct {
+	offset, size int64
+}
+
+func (t *tarImageSource) open(name string) (io.ReadCloser, error) {
+	m, ok := t.files[archivePath(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(io.NewSectionReader(t.f, m.offset, m.size)), nil
+}
+
+// offsetReader counts the offset in the file it reads. Seeking is passed on so that tar
+// can skip the contents of files.
+type offsetReader struct {
+	f      *os.File
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.offset = n
+	}
+	return n, err
+}
+
+func newTarImageSource(f *os.File) (*tarImageSource, error) {
+	t := &tarImageSource{f: f, files: make(map[string]tarMember)}
+
+	// docker save links layers that are the same in several images to one copy.
+	links := make(map[string]string)
+
+	or := &offsetReader{f: f}
+	tr := tar.NewReader(or)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := archivePath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			t.files[p] = tarMember{or.offset, hdr.Size}
+		case tar.TypeSymlink:
+			links[p] = archivePath(path.Join(path.Dir(p), hdr.Linkname))
+		case tar.TypeLink:
+			links[p] = archivePath(hdr.Linkname)
+		}
+	}
+
+	for p, target := range links {
+		if m, ok := t.files[target]; ok {
+			t.files[p] = m
+		}
+	}
+	return t, nil
+}
+
+// OpenImage reads the index of the container image name, which is either an OCI image layout
+// directory or a tarball written by docker save. The layers are read but not kept in memory.
+func OpenImage(name string) (*ImageFs, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var src imageSource
+	if fi.IsDir() {
+		src = dirImageSource(name)
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		src, err = newTarImageSource(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	layers, err := imageLayers(src)
+	if err != nil {
+		return nil, fmt.Errorf("Reading image %s failed: %v", name, err)
+	}
+
+	m := &ImageFs{ArchiveFs: newArchiveFs(filepath.Base(name))}
+	for i, l := range layers {
+		if err := m.addLayer(src, l, i+1); err != nil {
+			return nil, fmt.Errorf("Reading layer %s of image %s failed: %v", l, name, err)
+		}
+	}
+	return m, nil
+}
+
+// readJSON decodes the file name of src into v.
+func readJSON(src imageSource, name string, v interface{}) error {
+	r, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// dockerManifest is an entry of the manifest.json file written by docker save.
+type dockerManifest struct {
+	Layers []string
+}
+
+// ociDescriptor describes a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+// ociManifest is either an image index or an image manifest.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// digestAlg and digestHex match the parts of the digests that blobPath accepts, so that a digest can't
+// name a file outside the blobs of the layout.
+var (
+	digestAlg = regexp.MustCompile("^[a-z0-9]+$")
+	digestHex = regexp.MustCompile("^[a-f0-9]+$")
+)
+
+// blobPath returns the path of the blob with the digest d in an OCI image layout.
+func blobPath(d string) (string, error) {
+	alg, hex, ok := strings.Cut(d, ":")
+	if !ok || !digestAlg.MatchString(alg) || !digestHex.MatchString(hex) {
+		return "", fmt.Errorf("invalid digest '%s'", d)
+	}
+	return path.Join("blobs", alg, hex), nil
+}
+
+// imageLayers returns the paths of the layers of the image in src, from the bottom layer up.
+// If the image holds several manifests, the first is used.
+func imageLayers(src imageSource) ([]string, error) {
+	var dms []dockerManifest
+	err := readJSON(src, "manifest.json", &dms)
+	if err == nil {
+		if len(dms) == 0 {
+			return nil, fmt.Errorf("manifest.json lists no images")
+		}
+		return dms[0].Layers, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var m ociManifest
+	if err := readJSON(src, "index.json", &m); err != nil {
+		return nil, err
+	}
+
+	// Follow nested indexes down to an image manifest.
+	for len(m.Layers) == 0 {
+		if len(m.Manifests) == 0 {
+			return nil, fmt.Errorf("index lists no manifests")
+		}
+		p, err := blobPath(m.Manifests[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		m = ociManifest{}
+		if err := readJSON(src, p, &m); err != nil {
+			return nil, err
+		}
+	}
+
+	var layers []string
+	for _, l := range m.Layers {
+		p, err := blobPath(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, p)
+	}
+	return layers, nil
+}
+
+// addLayer applies the layer in the file name of src on top of the image, as the layer with the one-based index i.
+func (m *ImageFs) addLayer(src imageSource, name string, i int) error {
+	rc, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Layers may or may not be compressed, whatever the media type says.
+	r := bufio.NewReader(rc)
+	var lr io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		lr = gz
+	}
+
+	layer := newArchiveFs(m.root)
+	m.layers = append(m.layers, layer)
+
+	tr := tar.NewReader(lr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := archivePath(hdr.Name)
+		dir, base := path.Dir(p), path.Base(p)
+
+		if base == whiteoutOpaque {
+			if _, ok := m.entries[dir]; ok {
+				m.hideLower(dir, i)
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			m.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		e := newTarEntry(hdr)
+		e.layer = i
+		if old, ok := m.entries[p]; ok && old.IsDir() && !e.IsDir() {
+			// A directory replaced by something else takes its entries with it.
+			m.remove(p)
+		}
+
+		le := *e
+		layer.add(hdr.Name, &le)
+		m.add(hdr.Name, e)
+	}
+}
+
+// hideLower removes the entries of the layers below the layer i from the directory p and from all the
+// directories under it, for an opaque whiteout in p. The directories that hold entries of the layer i are kept.
+func (m *ImageFs) hideLower(p string, i int) {
+	var kept []string
+	for _, c := range m.children[p] {
+		e := m.entries[c]
+		if e.IsDir() {
+			m.hideLower(c, i)
+		}
+		if e.layer >= i || len(m.children[c]) > 0 {
+			kept = append(kept, c)
+		} else {
+			delete(m.entries, c)
+		}
+	}
+	m.children[p] = kept
+	if kept == nil {
+		delete(m.children, p)
+	}
+}
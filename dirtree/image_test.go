@@ -0,0 +1,209 @@
+package dirtree
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayer is a layer of a test image. It maps the path of each file to its size.
+type testLayer map[string]int
+
+func (l testLayer) tar(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	w := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = tar.NewWriter(gz)
+	}
+
+	for name, size := range l {
+		w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(size), Mode: 0644})
+		w.Write(make([]byte, size))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+var testLayers = []testLayer{
+	{"usr/bin/sh": 100, "usr/lib/libc": 200, "etc/passwd": 10, "var/cache/a": 50, "var/cache/b": 60},
+	{"usr/bin/.wh.sh": 0, "var/cache/.wh..wh..opq": 0, "var/cache/c": 5},
+	{"usr/lib/libc": 300, "etc": 7},
+}
+
+func checkImage(t *testing.T, m *ImageFs) {
+	if m.Layers() != 3 {
+		t.Fatal("Image should have 3 layers but has", m.Layers())
+	}
+
+	opts := *DefaultBuildOpts
+	opts.IncludeFiles = true
+
+	ops := make(chan OpData)
+	go build(m, m.Root(), ops, nil, &opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+
+	// etc was replaced by a file, so passwd is gone. Nothing in bin contributes bytes.
+	expected := map[string][2]int64{
+		"usr":   {300, 3},
+		"bin":   {0, 0},
+		"lib":   {300, 3},
+		"libc":  {300, 3},
+		"etc":   {7, 3},
+		"var":   {5, 2},
+		"cache": {5, 2},
+		"c":     {5, 2},
+	}
+
+	detected := 0
+	tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		if depth == 0 {
+			if n.Info.Size != 312 || n.Info.Layer != 3 {
+				t.Fatal("Root should have size 312 from layer 3 but has", n.Info.Size, "from layer", n.Info.Layer)
+			}
+			return true, false
+		}
+		e, ok := expected[n.Info.Basename]
+		if !ok {
+			t.Fatal("Path", n.Info.Path, "wasn't expected")
+		}
+		if got := [2]int64{n.Info.Size, int64(n.Info.Layer)}; got != e {
+			t.Fatal("Path", n.Info.Path, "should have size and layer", e, "but has", got)
+		}
+		detected++
+		return true, false
+	}, 0)
+
+	if detected != len(expected) {
+		t.Fatal("Tree should have", len(expected), "paths below the root but has", detected)
+	}
+
+	// The first layer on its own still has everything it added.
+	ops = make(chan OpData)
+	go build(m.Layer(1), m.Root(), ops, nil, &opts)
+	tree = New()
+	tree.ApplyAll(ops)
+	if tree.Root.Info.Size != 420 {
+		t.Fatal("Layer 1 should have size 420 but has", tree.Root.Info.Size)
+	}
+}
+
+func TestImageDockerSave(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(data)), Mode: 0644})
+		w.Write(data)
+	}
+	add("manifest.json", []byte(`[{"Config":"config.json","RepoTags":["test:latest"],"Layers":["1/layer.tar","2/layer.tar","3/layer.tar"]}]`))
+	add("1/layer.tar", testLayers[0].tar(t, false))
+	add("2/layer.tar", testLayers[1].tar(t, false))
+	add("3/layer.tar", testLayers[2].tar(t, true))
+	w.Close()
+
+	name := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenImage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, m)
+}
+
+func TestImageOCILayout(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	write("index.json", []byte(`{"manifests":[{"digest":"sha256:1a"}]}`))
+	write("blobs/sha256/1a", []byte(`{"manifests":[{"digest":"sha256:2b"}]}`))
+	write("blobs/sha256/2b", []byte(`{"layers":[{"digest":"sha256:c1"},{"digest":"sha256:c2"},{"digest":"sha256:c3"}]}`))
+	write("blobs/sha256/c1", testLayers[0].tar(t, true))
+	write("blobs/sha256/c2", testLayers[1].tar(t, true))
+	write("blobs/sha256/c3", testLayers[2].tar(t, false))
+
+	m, err := OpenImage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, m)
+}
+
+func TestImageOpaqueWhiteout(t *testing.T) {
+	dir := t.TempDir()
+	writeLayer := func(name string, hdrs []*tar.Header) {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			w.WriteHeader(hdr)
+			w.Write(make([]byte, hdr.Size))
+		}
+		w.Close()
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLayer("1", []*tar.Header{
+		{Name: "var/cache/a", Typeflag: tar.TypeReg, Size: 10, Mode: 0644},
+		{Name: "var/cache/sub/b", Typeflag: tar.TypeReg, Size: 20, Mode: 0644},
+		{Name: "var/cache/sub/deep/c", Typeflag: tar.TypeReg, Size: 30, Mode: 0644},
+	})
+	// The directory sub is added again before the whiteout, which hides what was in it all the same.
+	writeLayer("2", []*tar.Header{
+		{Name: "var/cache/sub/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/cache/sub/d", Typeflag: tar.TypeReg, Size: 5, Mode: 0644},
+		{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	m := &ImageFs{ArchiveFs: newArchiveFs("image")}
+	for i, name := range []string{"1", "2"} {
+		if err := m.addLayer(dirImageSource(dir), name, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"var/cache/a", "var/cache/sub/b", "var/cache/sub/deep", "var/cache/sub/deep/c"} {
+		if _, ok := m.entries[p]; ok {
+			t.Fatal("The opaque whiteout should hide", p)
+		}
+	}
+	for _, p := range []string{"var/cache/sub", "var/cache/sub/d"} {
+		if _, ok := m.entries[p]; !ok {
+			t.Fatal("The opaque whiteout should not hide", p, "from the same layer")
+		}
+	}
+}
+
+func TestBlobPath(t *testing.T) {
+	if p, err := blobPath("sha256:0123abcdef"); err != nil || p != "blobs/sha256/0123abcdef" {
+		t.Fatal("The digest should be in blobs/sha256/0123abcdef but is in", p, err)
+	}
+	for _, d := range []string{"sha256", "sha256:../../x", "../sha256:ab", "SHA256:ab", "sha256:AB", "sha256:", ":ab"} {
+		if _, err := blobPath(d); err == nil {
+			t.Fatal("The digest", d, "should be rejected")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package dirtree
+
+import (
+	"os"
+	"time"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// BuildIncremental is like Build, but uses the tree prev built earlier from the same path with the same
+// options, such as one loaded from a snapshot, to avoid reading directories that did not change.
+//
+// A directory whose modification and change times are the same as when prev was built, and that had no
+// errors, is not read. Instead the entries and sizes recorded in prev are used, and only its subdirectories
+// are looked up to check whether they changed. The operations written to ops are the same as for a full build.
+// Changes to the contents of files that don't change the directory that holds them, such as a file
+// growing, are not seen. Builds that count hard links with HardLinksShared read every directory, and
+// builds that use HardLinksFirstPath read every directory that holds files with several hard links.
+func BuildIncremental(prev *Dirtree, basepath string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+	o := *opts
+	o.Previous = prev
+	return Build(basepath, &o)
+}
+
+// dirStamp holds the times of a directory that change when entries are added to or removed from it.
+type dirStamp struct {
+	modTime, changeTime time.Time
+}
+
+func newDirStamp(fi os.FileInfo) dirStamp {
+	s := dirStamp{modTime: fi.ModTime()}
+	if ctime, err := sh.GetChangeTime(fi); err == nil {
+		s.changeTime = ctime
+	}
+	return s
+}
+
+// prevIndex finds the directories of the previous tree of an incremental build.
+// A nil *prevIndex is used for full builds.
+type prevIndex struct {
+	sfs   StatFilesystem
+	opts  *BuildOpts
+	nodes map[string]*Node
+}
+
+func newPrevIndex(fs Filesystem, opts *BuildOpts) *prevIndex {
+	sfs, ok := fs.(StatFilesystem)
+	if opts.Previous == nil || opts.Previous.Root == nil || !ok || opts.HardLinks == HardLinksShared {
+		return nil
+	}
+
+	p := &prevIndex{sfs: sfs, opts: opts, nodes: make(map[string]*Node)}
+	opts.Previous.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		if n.Info.Type == PathTypeDir || n.Info.Type == PathTypeSymlinkDir {
+			p.nodes[n.Info.Path] = n
+		}
+		return true, false
+	}, 0)
+	return p
+}
+
+// stamp returns the current stamp of the directory path.
+func (p *prevIndex) stamp(path string) dirStamp {
+	if p == nil {
+		return dirStamp{}
+	}
+	fi, err := p.sfs.Stat(path)
+	if err != nil {
+		return dirStamp{}
+	}
+	return newDirStamp(fi)
+}
+
+// reusable returns the node in the previous tree for the directory path if the directory is unchanged
+// and the node can be used instead of reading it. Otherwise it returns nil.
+func (p *prevIndex) reusable(path string, stamp dirStamp) *Node {
+	if p == nil || stamp.modTime.IsZero() {
+		return nil
+	}
+
+	n := p.nodes[path]
+	if n == nil || len(n.Info.Errors) > 0 || n.Info.ModTime.IsZero() ||
+		!n.Info.ModTime.Equal(stamp.modTime) || !n.Info.ChangeTime.Equal(stamp.changeTime) {
+		return nil
+	}
+
+	if p.opts.HardLinks == HardLinksFirstPath && ownSharedSize(n) > 0 {
+		// A file with several hard links is only counted in the first directory read that links to it,
+		// so the directories that hold such files are read again to find which one that is.
+		return nil
+	}
+
+	if p.opts.IncludeFiles {
+		// The files must be in the tree to be included.
+		var leaves, leafEntries int64
+		entries := n.Info.Files + n.Info.Other
+		for _, c := range n.Children {
+			if c.Info.Type.isDirLike() {
+				entries -= c.Info.Files + c.Info.Other
+			} else {
+				leaves++
+				leafEntries += c.Info.Files + c.Info.Other
+			}
+		}
+		if leafEntries != entries || leaves != entries {
+			return nil
+		}
+	}
+
+	return n
+}
+
+// ownSharedSize returns the size of the files with several hard links in the directory n itself,
+// rather than in its subdirectories.
+func ownSharedSize(n *Node) int64 {
+	size := n.Info.SharedSize
+	for _, c := range n.Children {
+		if c.Info.Type.isDirLike() {
+			size -= c.Info.SharedSize
+		}
+	}
+	return size
+}
+
+// reuseDir fills in the listing l from the node l.prev of the previous tree, instead of reading the
+// directory. The subdirectories are looked up to find their current stamps.
+func (r *dirReader) reuseDir(l *dirListing) {
+	n := l.prev
+	sfs := r.fs.(StatFilesystem)
+
+	// The totals that belong to the directory itself, rather than its subdirectories.
+	own := n.Info
+	own.Errors = nil
+	own.Types = own.Types.clone()
+	own.Users, own.Groups = own.Users.clone(), own.Groups.clone()
+	l.accurate = true
+
+	for _, c := range n.Children {
+		ci := &c.Info
+		if !ci.Type.isDirLike() {
+			// Mount points that were not read are kept like directories.
+			if r.opts.IncludeFiles || ci.Type == PathTypeMount {
+				own.addTotals(ci.negTotals())
+				l.entries = append(l.entries, OpData{Op: Push, Path: ci.Path, Basename: ci.Basename, SizeAccurate: true, Type: ci.Type,
+					Size: ci.Size, AllocSize: ci.AllocSize, SharedSize: ci.SharedSize, Files: ci.Files, Dirs: ci.Dirs, Other: ci.Other,
+					Layer: ci.Layer, Types: ci.Types, Users: ci.Users, Groups: ci.Groups, FsType: ci.FsType, Times: ci.Times})
+				l.inodes = append(l.inodes, inode{})
+				l.stamps = append(l.stamps, dirStamp{})
+			}
+			continue
+		}
+
+		own.addTotals(ci.negTotals())
+		// The subdirectory is counted again when it's traversed.
+		own.Dirs--
+
+		r.throttle.stat()
+		fi, err := sfs.Stat(ci.Path)
+		if err != nil || !fi.IsDir() {
+			if err == nil {
+				err = &os.PathError{Op: "stat", Path: ci.Path, Err: os.ErrNotExist}
+			}
+			l.errors = append(l.errors, newScanError(ci.Path, err))
+			l.accurate = false
+			continue
+		}
+
+		// The inode is recorded like that of a directory that is read, so that links to it are not followed.
+		var in inode
+		if dev, ino, _, err := sh.GetLinkInfo(fi); err == nil {
+			in = inode{dev, ino}
+		}
+		l.entries = append(l.entries, OpData{Op: Push, Path: ci.Path, Basename: ci.Basename, SizeAccurate: true, Type: ci.Type, Times: r.entryTimes(fi)})
+		l.inodes = append(l.inodes, in)
+		l.stamps = append(l.stamps, newDirStamp(fi))
+	}
+
+	l.size, l.allocSize, l.sharedSize = own.Size, own.AllocSize, own.SharedSize
+	l.files, l.dirs, l.other = own.Files, own.Dirs, own.Other
+	l.layer = own.Layer
+	l.types = own.Types
+	l.users, l.groups = own.Users, own.Groups
+	l.sparse = n.Info.Sparse
+	l.times = own.Times
+}
@@ -0,0 +1,168 @@
+package dirtree
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// makeStampedTestFs returns the filesystem from makeTestFs with fixed modification times for the directories.
+func makeStampedTestFs() TestFs {
+	fs := makeTestFs()
+	stamp := time.Unix(5000, 0)
+	for _, dir := range []string{"/tmp", "/tmp/b"} {
+		for i, fi := range fs.Files[dir] {
+			if tfi := fi.(TestFileInfo); tfi.IsDir() {
+				tfi.mtime = stamp
+				fs.Files[dir][i] = tfi
+			}
+		}
+	}
+	return fs
+}
+
+func buildIncrementalTree(fs TestFs, opts *BuildOpts) *Dirtree {
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+	return tree
+}
+
+func TestBuildIncremental(t *testing.T) {
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+		opts.FileTypes = FileTypesExtension
+
+		prev := buildIncrementalTree(makeStampedTestFs(), &opts)
+
+		// Nothing changed, so the result is the same.
+		opts.Previous = prev
+		tree := buildIncrementalTree(makeStampedTestFs(), &opts)
+		compareNodes(t, prev.Root, tree.Root)
+
+		// A file grows in a directory that is not changed, so the old size is used. A file is added
+		// to /tmp/b/dir, which changes it, so it's read again.
+		fs := makeStampedTestFs()
+		fs.Files["/tmp/a"][0] = NewTestFileInfo("file1.txt", false, 1000)
+		fs.Files["/tmp/b/dir"] = append(fs.Files["/tmp/b/dir"], NewTestFileInfo("new", false, 7))
+		fi := fs.Files["/tmp/b"][1].(TestFileInfo)
+		fi.mtime = time.Unix(6000, 0)
+		fs.Files["/tmp/b"][1] = fi
+
+		tree = buildIncrementalTree(fs, &opts)
+
+		expected := map[string]int64{"tmp": 72, "a": 30, "b": 42, "dir": 37}
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			if n.Info.Type != PathTypeDir {
+				return true, false
+			}
+			if n.Info.Size != expected[n.Info.Basename] {
+				t.Fatal("With files", includeFiles, "directory", n.Info.Basename, "should have size", expected[n.Info.Basename], "but has", n.Info.Size)
+			}
+			return true, false
+		}, 0)
+
+		if tree.Root.Info.Dirs != 3 {
+			t.Fatal("With files", includeFiles, "root should contain 3 directories but contains", tree.Root.Info.Dirs)
+		}
+	}
+}
+
+func TestBuildIncrementalVanished(t *testing.T) {
+	opts := *DefaultBuildOpts
+	prev := buildIncrementalTree(makeStampedTestFs(), &opts)
+
+	// /tmp/b/dir is gone, but /tmp/b looks unchanged.
+	fs := makeStampedTestFs()
+	delete(fs.Files, "/tmp/b/dir")
+	fs.Files["/tmp/b"] = fs.Files["/tmp/b"][:1]
+
+	opts.Previous = prev
+	tree := buildIncrementalTree(fs, &opts)
+
+	b := tree.Root.Children[1]
+	if b.Info.Basename != "b" || b.Info.SizeAccurate || len(b.Info.Errors) != 1 || b.Info.Errors[0].Kind != ErrorVanished {
+		t.Fatal("Directory b should be inaccurate with one vanished error but is", b.Info)
+	}
+	if len(b.Children) != 0 {
+		t.Fatal("Directory b should have no children but has", len(b.Children))
+	}
+}
+
+func TestBuildIncrementalHardLinks(t *testing.T) {
+	link := func(name string) TestFileInfo {
+		fi := NewTestFileInfo(name, false, 100)
+		fi.ino = 5
+		fi.nlink = 2
+		return fi
+	}
+	stamped := func(name string, mtime int64) TestFileInfo {
+		fi := NewTestFileInfo(name, true, 0)
+		fi.mtime = time.Unix(mtime, 0)
+		return fi
+	}
+	makeFs := func(aTime, bTime int64) TestFs {
+		return TestFs{
+			Files: map[string]TestFile{
+				"/tmp":   TestFile{stamped("a", aTime), stamped("b", bTime)},
+				"/tmp/a": TestFile{link("x"), NewTestFileInfo("z", false, 10)},
+				"/tmp/b": TestFile{link("x")},
+			},
+		}
+	}
+
+	opts := *DefaultBuildOpts
+	opts.HardLinks = HardLinksFirstPath
+	prev := buildIncrementalTree(makeFs(5000, 5000), &opts)
+	if prev.Root.Info.Size != 110 {
+		t.Fatal("The link should be counted once, so the root should have size 110 but has", prev.Root.Info.Size)
+	}
+
+	// One of the directories changed and the other didn't, but the link is still only counted once.
+	opts.Previous = prev
+	for _, times := range [][2]int64{{6000, 5000}, {5000, 6000}} {
+		tree := buildIncrementalTree(makeFs(times[0], times[1]), &opts)
+		if tree.Root.Info.Size != 110 {
+			t.Fatal("With times", times, "the link should be counted once, so the root should have size 110 but has", tree.Root.Info.Size)
+		}
+	}
+}
+
+func TestBuildIncrementalSymlinks(t *testing.T) {
+	dir := func(name string, ino uint64, mtime int64) TestFileInfo {
+		return TestFileInfo{name: name, mode: os.ModeDir, ino: ino, mtime: time.Unix(mtime, 0)}
+	}
+	sub := dir("sub", 4, 5000)
+	makeFs := func(yTime int64) TestFs {
+		return TestFs{
+			Files: map[string]TestFile{
+				"/tmp":        TestFile{dir("y", 3, yTime), dir("a", 2, 5000)},
+				"/tmp/a":      TestFile{sub},
+				"/tmp/a/sub":  TestFile{NewTestFileInfo("file", false, 10)},
+				"/tmp/y":      TestFile{TestFileInfo{name: "link", mode: os.ModeSymlink, size: 5, ino: 5}},
+				"/tmp/y/link": TestFile{NewTestFileInfo("file", false, 10)},
+			},
+			Targets: map[string]os.FileInfo{
+				"/tmp":        TestFileInfo{name: "tmp", mode: os.ModeDir, ino: 1},
+				"/tmp/y/link": sub,
+			},
+		}
+	}
+
+	opts := *DefaultBuildOpts
+	opts.FollowSymlinks = SymlinksAlways
+	prev := buildIncrementalTree(makeFs(5000), &opts)
+	if prev.Root.Info.Size != 10 {
+		t.Fatal("The link to sub should not be followed, so the root should have size 10 but has", prev.Root.Info.Size)
+	}
+
+	// Directory a is reused, and the link to sub is still not followed.
+	opts.Previous = prev
+	tree := buildIncrementalTree(makeFs(6000), &opts)
+	if tree.Root.Info.Size != 10 {
+		t.Fatal("The link to the reused directory sub should not be followed, so the root should have size 10 but has", tree.Root.Info.Size)
+	}
+}
@@ -0,0 +1,134 @@
+package dirtree
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// FSDeviceId is the identifier of the synthetic device that all paths of a Filesystem returned by FromFS reside on.
+const FSDeviceId = 1
+
+// FromFS returns a Filesystem that reads the standard filesystem fsys, such as an embed.FS, fstest.MapFS or zip.Reader.
+//
+// Paths are given in the syntax of io/fs, although a leading slash or a leading ./ is accepted. Since a build
+// joins the names of entries to the directory it starts from, building from "." produces paths such as "./a/b".
+// Symbolic links are only followed if fsys implements io/fs.StatFS or resolves links in Open.
+func FromFS(fsys iofs.FS) Filesystem {
+	return fsFilesystem{fsys}
+}
+
+// BuildFS builds a tree of the standard filesystem fsys, starting from the directory root. It is the same as
+// calling BuildFs with FromFS(fsys).
+func BuildFS(fsys iofs.FS, root string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+	return BuildFs(FromFS(fsys), root, opts)
+}
+
+type fsFilesystem struct {
+	fsys iofs.FS
+}
+
+// fsPath converts the path p used by a build to a path valid for io/fs.
+func fsPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func (f fsFilesystem) Open(p string) (file File, err error) {
+	fl, err := f.fsys.Open(fsPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{fl, p}, nil
+}
+
+func (f fsFilesystem) DeviceId(p string) (id uint64, err error) {
+	if _, err := iofs.Stat(f.fsys, fsPath(p)); err != nil {
+		return 0, err
+	}
+	return FSDeviceId, nil
+}
+
+// Stat returns information about the file the path refers to, following symbolic links.
+func (f fsFilesystem) Stat(p string) (os.FileInfo, error) {
+	fi, err := iofs.Stat(f.fsys, fsPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo(fi), nil
+}
+
+// fsFileInfo returns fi with the device replaced by the synthetic device if fi describes
+// an operating system file, so that the information agrees with DeviceId.
+func fsFileInfo(fi os.FileInfo) os.FileInfo {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi
+	}
+	stc := *st
+	stc.Dev = FSDeviceId
+	return fsStatFileInfo{fi, &stc}
+}
+
+type fsStatFileInfo struct {
+	os.FileInfo
+	st *syscall.Stat_t
+}
+
+func (f fsStatFileInfo) Sys() interface{} {
+	return f.st
+}
+
+type fsDirEntry struct {
+	iofs.DirEntry
+}
+
+func (d fsDirEntry) Info() (os.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo(fi), nil
+}
+
+// fsFile is an open file of an fsFilesystem.
+type fsFile struct {
+	iofs.File
+	path string
+}
+
+func (f *fsFile) ReadDir(count int) ([]iofs.DirEntry, error) {
+	d, ok := f.File.(iofs.ReadDirFile)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: f.path, Err: errors.New("not implemented")}
+	}
+
+	des, err := d.ReadDir(count)
+	for i, de := range des {
+		des[i] = fsDirEntry{de}
+	}
+	return des, err
+}
+
+func (f *fsFile) Readdir(count int) ([]os.FileInfo, error) {
+	des, err := f.ReadDir(count)
+
+	fis := make([]os.FileInfo, 0, len(des))
+	for _, de := range des {
+		fi, ierr := de.Info()
+		if ierr != nil {
+			if err == nil {
+				err = ierr
+			}
+			continue
+		}
+		fis = append(fis, fi)
+	}
+	return fis, err
+}
@@ -0,0 +1,92 @@
+package dirtree
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// buildFSTree builds a tree of fsys using BuildFS.
+func buildFSTree(fsys fs.FS, root string) *Dirtree {
+	ops, prog := BuildFS(fsys, root, DefaultBuildOpts)
+	go func() {
+		for range prog {
+		}
+	}()
+
+	tree := New()
+	tree.ApplyAll(ops)
+	return tree
+}
+
+func TestBuildFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/file1.txt": {Data: make([]byte, 20)},
+		"a/file2.txt": {Data: make([]byte, 10)},
+		"b/a.txt":     {Data: make([]byte, 5)},
+		"b/dir/blort": {Data: make([]byte, 30)},
+		"b/dir/empty": {Mode: os.ModeDir},
+	}
+
+	expected := map[string]int64{
+		"tmp":   65,
+		"a":     30,
+		"b":     35,
+		"dir":   30,
+		"empty": 0,
+	}
+
+	for _, root := range []string{".", "/", "b"} {
+		tree := buildFSTree(fsys, root)
+
+		if tree.Root == nil {
+			t.Fatal("Building from", root, "produced no tree")
+		}
+
+		detected := 0
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			name := n.Info.Basename
+			if depth == 0 {
+				if root != "b" {
+					name = "tmp"
+				}
+			}
+			if n.Info.Size != expected[name] {
+				t.Fatal("Building from", root, "directory", n.Info.Path, "should have size", expected[name], "but has", n.Info.Size)
+			}
+			detected++
+			return true, false
+		}, 0)
+
+		want := len(expected)
+		if root == "b" {
+			want = 3
+		}
+		if detected != want {
+			t.Fatal("Building from", root, "should find", want, "directories but found", detected)
+		}
+	}
+}
+
+func TestBuildFSDirFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "b", "file"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The devices reported by the operating system must not cause directories to be
+	// treated as other filesystems.
+	tree := buildFSTree(os.DirFS(dir), ".")
+
+	if tree.Root.Info.Size != 100 {
+		t.Fatal("Root should have size 100 but has", tree.Root.Info.Size)
+	}
+	if tree.Root.Info.Dirs != 2 {
+		t.Fatal("Root should contain 2 directories but contains", tree.Root.Info.Dirs)
+	}
+}
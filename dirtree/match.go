@@ -0,0 +1,118 @@
+package dirtree
+
+import (
+	"path"
+	"strings"
+)
+
+// Pattern is a gitignore-style pattern used to include or exclude paths from a build.
+//
+// A pattern that contains no slash, other than a trailing one, is matched against the basename
+// of a path. Any other pattern is matched against the path relative to the root of the tree,
+// whether or not it starts with a slash, and also matches everything below the paths it matches.
+// A trailing slash restricts the pattern to directories. In patterns matched against the full
+// path, the component ** matches zero or more directories. Otherwise the syntax of path.Match
+// is used.
+type Pattern struct {
+	text    string
+	dirOnly bool
+	full    bool
+	// Components of the pattern, for patterns matched against the full path.
+	comps []string
+}
+
+// CompilePattern parses the pattern s.
+func CompilePattern(s string) (*Pattern, error) {
+	p := &Pattern{text: s}
+
+	if strings.HasSuffix(s, "/") && len(s) > 1 {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+
+	p.full = strings.Contains(s, "/")
+	if p.full {
+		p.comps = strings.Split(strings.Trim(s, "/"), "/")
+		for _, c := range p.comps {
+			if _, err := path.Match(c, ""); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, err
+		}
+		p.comps = []string{s}
+	}
+
+	return p, nil
+}
+
+// CompilePatterns parses each of the patterns in s.
+func CompilePatterns(s []string) ([]*Pattern, error) {
+	var pats []*Pattern
+	for _, v := range s {
+		p, err := CompilePattern(v)
+		if err != nil {
+			return nil, err
+		}
+		pats = append(pats, p)
+	}
+	return pats, nil
+}
+
+func (p *Pattern) String() string {
+	return p.text
+}
+
+// Match returns true if the pattern matches the path fullpath, which is relative to the root of the
+// build. isDir specifies if the path is a directory.
+func (p *Pattern) Match(fullpath string, isDir bool) bool {
+	if !p.full {
+		if p.dirOnly && !isDir {
+			return false
+		}
+		ok, _ := path.Match(p.comps[0], path.Base(fullpath))
+		return ok
+	}
+
+	comps := strings.Split(strings.Trim(fullpath, "/"), "/")
+	return matchComps(p.comps, comps, isDir || !p.dirOnly)
+}
+
+// matchComps returns true if the pattern components pat match a leading portion of the path components
+// comps. If the pattern only matches all of comps, lastOk specifies whether that is a match.
+func matchComps(pat, comps []string, lastOk bool) bool {
+	if len(pat) == 0 {
+		// Anything left in comps is below a matched path.
+		return len(comps) > 0 || lastOk
+	}
+
+	if pat[0] == "**" {
+		for i := 0; i <= len(comps); i++ {
+			if matchComps(pat[1:], comps[i:], lastOk) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(comps) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pat[0], comps[0]); !ok {
+		return false
+	}
+	return matchComps(pat[1:], comps[1:], lastOk)
+}
+
+// matchAny returns true if any of the patterns match the path.
+func matchAny(pats []*Pattern, fullpath string, isDir bool) bool {
+	for _, p := range pats {
+		if p.Match(fullpath, isDir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package dirtree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"node_modules", "/src/app/node_modules", true, true},
+		{"node_modules", "/src/app/node_modules", false, true},
+		{"node_modules/", "/src/app/node_modules", false, false},
+		{"node_modules/", "/src/app/node_modules", true, true},
+		{"*.log", "/var/log/syslog.log", false, true},
+		{"*.log", "/var/log/syslog", false, false},
+		{".snapshot", "/home/.snapshot", true, true},
+		{"/proc", "/proc", true, true},
+		{"/proc", "/proc/1/status", false, true},
+		{"/proc", "/home/proc", true, false},
+		{"/var/*/cache", "/var/lib/cache", true, true},
+		{"/var/*/cache", "/var/lib/apt/cache", true, false},
+		{"/var/**/cache", "/var/lib/apt/cache", true, true},
+		{"/var/**/cache", "/var/cache", true, true},
+		{"**/tmp/", "/a/b/tmp", true, true},
+		{"**/tmp/", "/a/b/tmp", false, false},
+		{"**/tmp/", "/a/b/tmp/file", false, true},
+	}
+
+	for _, tc := range tests {
+		p, err := CompilePattern(tc.pattern)
+		if err != nil {
+			t.Fatal("Compiling pattern", tc.pattern, "failed:", err)
+		}
+		if p.Match(tc.path, tc.isDir) != tc.match {
+			t.Fatal("Pattern", tc.pattern, "matching path", tc.path, "(dir:", tc.isDir, ") should return", tc.match)
+		}
+	}
+
+	if _, err := CompilePattern("/a/[b"); err == nil {
+		t.Fatal("Compiling an invalid pattern should fail")
+	}
+}
+
+func TestBuildExclude(t *testing.T) {
+	fs := makeTestFs()
+	// Excluded directories must not be opened.
+	delete(fs.Files, "/tmp/b/dir")
+
+	opts := *DefaultBuildOpts
+	opts.Exclude = []string{"dir/", "file2.txt"}
+
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, &opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+
+	expected := map[string]int64{
+		"tmp": 25,
+		"a":   20,
+		"b":   5,
+	}
+
+	count := 0
+	tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		size, ok := expected[n.Info.Basename]
+		if !ok {
+			t.Fatal("Directory with name", n.Info.Basename, "wasn't expected")
+		}
+		if n.Info.Size != size || !n.Info.SizeAccurate {
+			t.Fatal("Directory with name", n.Info.Basename, "should have accurate size", size, "but has size", n.Info.Size)
+		}
+		count++
+		return true, false
+	}, 0)
+
+	if count != len(expected) {
+		t.Fatal("Expected", len(expected), "directories but found", count)
+	}
+
+	opts.Exclude = nil
+	opts.Include = []string{"/b/**"}
+
+	ops = make(chan OpData)
+	go build(makeTestFs(), "/tmp", ops, nil, &opts)
+
+	tree = New()
+	tree.ApplyAll(ops)
+
+	if tree.Root.Info.Size != 35 {
+		t.Fatal("Only files under /tmp/b should be included but root has size", tree.Root.Info.Size)
+	}
+
+	// Patterns with a slash are matched relative to the root, whether it's absolute or not.
+	relFs := TestFs{Files: make(map[string]TestFile)}
+	for k, v := range makeTestFs().Files {
+		relFs.Files[strings.TrimPrefix(k, "/")] = v
+	}
+
+	opts.Include = nil
+	opts.Exclude = []string{"b/dir"}
+	for root, fs := range map[string]TestFs{"/tmp": makeTestFs(), "tmp": relFs} {
+		ops = make(chan OpData)
+		go build(fs, root, ops, nil, &opts)
+
+		tree = New()
+		tree.ApplyAll(ops)
+
+		if tree.Root.Info.Size != 35 {
+			t.Fatal("With root", root, "b/dir should be excluded but the root has size", tree.Root.Info.Size)
+		}
+	}
+
+	// When a directory under the root is read again, the patterns are still relative to the root.
+	ops = make(chan OpData)
+	go build(makeTestFs(), "/tmp", ops, nil, &opts)
+	tree = New()
+	tree.ApplyAll(ops)
+
+	b := childWithBasename(tree.Root, "b")
+	b.UpdateSize(0, 0, true)
+	b.DelAll()
+
+	subOpts := opts
+	subOpts.Root = "/tmp"
+	ops = make(chan OpData)
+	go build(makeTestFs(), "/tmp/b", ops, nil, &subOpts)
+	ctx := NewApplyContext(b)
+	for op := range ops {
+		tree.ApplyCtx(ctx, op)
+	}
+
+	if b.Info.Size != 5 || childWithBasename(b, "dir") != nil {
+		t.Fatal("b/dir should still be excluded after reading /tmp/b again, but /tmp/b has size", b.Info.Size)
+	}
+}
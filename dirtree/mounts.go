@@ -0,0 +1,145 @@
+package dirtree
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// MountOpts select the filesystems mounted under the root of a build that are read, by their type.
+type MountOpts struct {
+	// Allow, if it's not empty, lists the only filesystem types that are read, such as "ext4".
+	Allow []string
+	// Deny lists filesystem types that are not read, such as "nfs" or "tmpfs".
+	Deny []string
+	// Table is the mount table of the filesystem being built. If it's nil, the table is read from
+	// sh.MountInfoFile when building the local filesystem.
+	Table sh.MountTable
+}
+
+// Allowed returns true if filesystems of the type fstype are read.
+func (o *MountOpts) Allowed(fstype string) bool {
+	for _, v := range o.Deny {
+		if v == fstype {
+			return false
+		}
+	}
+	if len(o.Allow) == 0 {
+		return true
+	}
+	for _, v := range o.Allow {
+		if v == fstype {
+			return true
+		}
+	}
+	return false
+}
+
+// mountTable finds the mounts that directories of a build are on.
+type mountTable struct {
+	// points are the mounts by mount point. Only the last mount at each point is kept, since it hides the others.
+	points map[string]*sh.Mount
+	// crossed are the devices of the mount points that were read because their type is allowed. They are
+	// the devices of the directories, since on some filesystems, such as btrfs, they differ from the device
+	// in the mount table. The mutex guards crossed, which is added to by the build workers.
+	crossed map[uint64]bool
+	mutex   sync.Mutex
+	// base is the root of the build and absBase its absolute path, which the mount points are relative to.
+	base, absBase string
+}
+
+// newMountTable returns the mount table for a build of basepath from fs, or nil if there is none.
+func newMountTable(fs Filesystem, opts *BuildOpts, basepath string) *mountTable {
+	if !opts.OneFs && opts.Mounts == nil {
+		return nil
+	}
+
+	var table sh.MountTable
+	if opts.Mounts != nil {
+		table = opts.Mounts.Table
+	}
+	absBase := basepath
+	if _, ok := fs.(OsFilesystem); ok {
+		if table == nil {
+			// The mount points that are skipped are left unlabelled if the table can't be read.
+			table, _ = sh.ReadMountTable(sh.MountInfoFile)
+		}
+		if abs, err := filepath.Abs(basepath); err == nil {
+			absBase = abs
+		}
+	}
+	if len(table) == 0 {
+		return nil
+	}
+
+	t := &mountTable{points: make(map[string]*sh.Mount), crossed: make(map[uint64]bool), base: basepath, absBase: absBase}
+	for i := range table {
+		t.points[table[i].Point] = &table[i]
+	}
+	return t
+}
+
+// cross records that the mount point on the device dev is read.
+func (t *mountTable) cross(dev uint64) {
+	t.mutex.Lock()
+	t.crossed[dev] = true
+	t.mutex.Unlock()
+}
+
+// isCrossed returns true if a mount point on the device dev is read.
+func (t *mountTable) isCrossed(dev uint64) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.crossed[dev]
+}
+
+// at returns the mount at the directory fpath, or nil if it's not a mount point.
+func (t *mountTable) at(fpath string) *sh.Mount {
+	if t == nil {
+		return nil
+	}
+
+	// Paths under the root "/" start with "//".
+	abs := filepath.Clean(fpath)
+	if t.absBase != t.base {
+		rel, err := filepath.Rel(t.base, fpath)
+		if err != nil {
+			return nil
+		}
+		abs = filepath.Join(t.absBase, rel)
+	}
+	return t.points[abs]
+}
+
+// skipMount decides whether the directory fpath described by fi is left unread because it's on another
+// filesystem. It returns the type of the filesystem mounted at fpath, if it's a mount point in the table.
+func (r *dirReader) skipMount(fpath string, fi os.FileInfo) (fstype string, skip bool) {
+	if m := r.mounts.at(fpath); m != nil {
+		fstype = m.FsType
+		if r.opts.Mounts != nil {
+			if !r.opts.Mounts.Allowed(fstype) {
+				return fstype, true
+			}
+			if r.opts.OneFs {
+				if devId, err := r.deviceId(fpath, fi); err == nil {
+					r.mounts.cross(devId)
+				}
+			}
+			return fstype, false
+		}
+	}
+
+	if r.opts.OneFs {
+		// Directories under a mount that was crossed are on its device.
+		if devId, err := r.deviceId(fpath, fi); err == nil && r.baseDevId != devId && !r.mounts.isCrossed(devId) {
+			return fstype, true
+		}
+	}
+	return fstype, false
+}
@@ -0,0 +1,100 @@
+package dirtree
+
+import (
+	"bytes"
+	"testing"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// mountFs is a TestFs on which some directories are on other devices.
+type mountFs struct {
+	TestFs
+	devs map[string]uint64
+}
+
+func (f mountFs) DeviceId(path string) (uint64, error) {
+	return f.devs[path], nil
+}
+
+func TestBuildMounts(t *testing.T) {
+	fs := mountFs{makeTestFs(), map[string]uint64{"/tmp/a": 5, "/tmp/a/sub": 5, "/tmp/b/dir": 6}}
+	// A directory under a mount point, which is on the device of the mount.
+	fs.Files["/tmp/a"] = append(fs.Files["/tmp/a"], NewTestFileInfo("sub", true, 0))
+	fs.Files["/tmp/a/sub"] = TestFile{NewTestFileInfo("file3.txt", false, 7)}
+	// The devices in the table differ from those of the directories, as they do on btrfs.
+	table := sh.MountTable{
+		{Point: "/", FsType: "ext4", Dev: 0},
+		{Point: "/tmp/a", FsType: "nfs", Dev: 50},
+		{Point: "/tmp/b/dir", FsType: "ext4", Dev: 60},
+	}
+
+	tests := []struct {
+		name   string
+		oneFs  bool
+		mounts *MountOpts
+		size   int64
+		// The types of the mount points that are not read, by path.
+		skipped map[string]string
+	}{
+		{"onefs", true, nil, 5, map[string]string{"/tmp/a": "", "/tmp/b/dir": ""}},
+		{"all", true, &MountOpts{Table: table}, 72, map[string]string{}},
+		{"deny", true, &MountOpts{Deny: []string{"nfs"}, Table: table}, 35, map[string]string{"/tmp/a": "nfs"}},
+		{"allow", true, &MountOpts{Allow: []string{"ext4"}, Table: table}, 35, map[string]string{"/tmp/a": "nfs"}},
+		{"cross", false, &MountOpts{Deny: []string{"nfs", "ext4"}, Table: table}, 5, map[string]string{"/tmp/a": "nfs", "/tmp/b/dir": "ext4"}},
+	}
+
+	for _, tc := range tests {
+		opts := *DefaultBuildOpts
+		opts.OneFs = tc.oneFs
+		opts.Mounts = tc.mounts
+
+		ops := make(chan OpData)
+		go build(fs, "/tmp", ops, nil, &opts)
+		tree := New()
+		tree.ApplyAll(ops)
+
+		if tree.Root.Info.Size != tc.size {
+			t.Fatal(tc.name, ": the root should have size", tc.size, "but has", tree.Root.Info.Size)
+		}
+
+		skipped := make(map[string]string)
+		tree.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+			if n.Info.Type == PathTypeMount {
+				skipped[n.Info.Path] = n.Info.FsType
+				if len(n.Children) > 0 {
+					t.Fatal(tc.name, ": the mount point", n.Info.Path, "should not have children")
+				}
+			}
+			return true, false
+		}, 0)
+		if len(skipped) != len(tc.skipped) {
+			t.Fatal(tc.name, ": the mount points not read should be", tc.skipped, "but are", skipped)
+		}
+		for path, fstype := range tc.skipped {
+			if v, ok := skipped[path]; !ok || v != fstype {
+				t.Fatal(tc.name, ": the mount points not read should be", tc.skipped, "but are", skipped)
+			}
+		}
+	}
+}
+
+func TestSaveLoadMount(t *testing.T) {
+	opts := *DefaultBuildOpts
+	opts.Mounts = &MountOpts{Table: sh.MountTable{{Point: "/tmp/a", FsType: "nfs", Dev: 5}}, Deny: []string{"nfs"}}
+	tree := buildIncrementalTree(makeTestFs(), &opts)
+
+	var buf bytes.Buffer
+	if err := tree.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := childWithBasename(loaded.Root, "a")
+	if a == nil || a.Info.Type != PathTypeMount || a.Info.FsType != "nfs" {
+		t.Fatal("The mount point /tmp/a should be loaded as an nfs mount but is", a)
+	}
+}
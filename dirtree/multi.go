@@ -0,0 +1,169 @@
+package dirtree
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MultiRootBasename is the basename of the synthetic root of a tree built by BuildMulti. The path of
+// the synthetic root is empty.
+const MultiRootBasename = "<roots>"
+
+// BuildMulti is like Build, but builds several directories at once. The root of the tree is a synthetic
+// node of type PathTypeMulti whose children are the roots, in the order given. The roots are built one
+// after the other, and hard links are only recognized within each root, so the roots should not overlap.
+func BuildMulti(roots []string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+	return BuildMultiFsContext(context.Background(), OsFilesystem{}, roots, opts)
+}
+
+// BuildMultiContext is like BuildMulti, but stops when ctx is done, in the same way as BuildContext.
+func BuildMultiContext(ctx context.Context, roots []string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+	return BuildMultiFsContext(ctx, OsFilesystem{}, roots, opts)
+}
+
+// BuildMultiFsContext is like BuildMultiContext, but reads the filesystem fs.
+func BuildMultiFsContext(ctx context.Context, fs Filesystem, roots []string, opts *BuildOpts) (ops chan OpData, prog chan Progress) {
+
+	ops = make(chan OpData)
+	prog = make(chan Progress)
+
+	go buildMulti(ctx, fs, roots, ops, prog, opts)
+
+	return
+}
+
+func buildMulti(ctx context.Context, fs Filesystem, roots []string, ops chan OpData, prog chan Progress, opts *BuildOpts) {
+
+	defer close(ops)
+
+	if prog != nil {
+		defer close(prog)
+	}
+
+	send := func(op OpData) bool {
+		select {
+		case ops <- op:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// The Incomplete operations of the builds of the roots are dropped, and this one is sent instead.
+	defer func() {
+		if ctx.Err() == nil {
+			return
+		}
+
+		t := time.NewTimer(incompleteTimeout)
+		select {
+		case ops <- OpData{Op: Incomplete}:
+		case <-t.C:
+		}
+		t.Stop()
+	}()
+
+	if !send(OpData{Op: Push, Path: "", Basename: MultiRootBasename, SizeAccurate: true, Type: PathTypeMulti}) ||
+		!send(OpData{Op: Pop}) {
+		return
+	}
+
+	for _, root := range roots {
+		if !send(OpData{Op: Push, Path: root, Basename: filepath.Base(root), SizeAccurate: true}) {
+			return
+		}
+	}
+
+	if !send(OpData{Op: AddSize, Dirs: int64(len(roots)), SizeAccurate: true}) {
+		return
+	}
+
+	// The progress of the roots is reported as the progress of a single build.
+	var built Progress
+	start := time.Now()
+
+	// The roots are popped in the reverse of the order they were pushed.
+	for i := len(roots) - 1; i >= 0; i-- {
+		if ctx.Err() != nil || !buildMultiRoot(ctx, fs, roots[i], send, prog, &built, start, opts) {
+			return
+		}
+	}
+}
+
+// buildMultiRoot builds root, which was already pushed, and sends the operations with send. The progress
+// is written to prog added to built, the progress of the roots built since start, and then built is
+// updated. It returns false if the build was cancelled.
+func buildMultiRoot(ctx context.Context, fs Filesystem, root string, send func(OpData) bool, prog chan Progress, built *Progress, start time.Time, opts *BuildOpts) bool {
+	if opts.OneFs {
+		// The build of a root stops before reading it if the device can't be found.
+		if _, err := fs.DeviceId(root); err != nil {
+			built.Errors++
+			return send(OpData{Op: Pop}) &&
+				send(OpData{Op: Error, Path: root, Err: newScanError(root, err)}) &&
+				send(OpData{Op: AddSize})
+		}
+	}
+
+	ops := make(chan OpData)
+	var rprog chan Progress
+	progDone := make(chan struct{})
+	if prog != nil {
+		rprog = make(chan Progress)
+		go func() {
+			defer close(progDone)
+			var last Progress
+			for p := range rprog {
+				last = p
+				p = p.plus(*built)
+				p.setElapsed(start)
+				select {
+				case prog <- p:
+				case <-ctx.Done():
+				}
+			}
+			*built = built.plus(last)
+		}()
+	} else {
+		close(progDone)
+	}
+
+	go buildContext(ctx, fs, root, ops, rprog, opts)
+
+	// The operations are read until the build ends, even when they can't be sent, so that it isn't blocked.
+	first := true
+	for op := range ops {
+		if first && op.Op == Push && op.Path == root {
+			// The root is pushed under the synthetic root.
+			first = false
+			continue
+		}
+		first = false
+		if op.Op != Incomplete {
+			send(op)
+		}
+	}
+	<-progDone
+
+	return ctx.Err() == nil
+}
+
+// BuildRoot returns the root that path was built from. That's the root of the tree, unless the tree was
+// built by BuildMulti, in which case it's the child of the synthetic root that holds path, or nil if
+// there is none.
+func (t *Dirtree) BuildRoot(path string) *Node {
+	n := t.Root
+	if n == nil || n.Info.Type != PathTypeMulti {
+		return n
+	}
+
+	sep := string(os.PathSeparator)
+	for _, c := range n.Children {
+		if path == c.Info.Path || strings.HasPrefix(path, c.Info.Path+sep) {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package dirtree
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func buildMultiTree(fs Filesystem, roots []string, opts *BuildOpts) *Dirtree {
+	ops := make(chan OpData)
+	go buildMulti(context.Background(), fs, roots, ops, nil, opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+	return tree
+}
+
+func TestBuildMulti(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = true
+		opts.Workers = workers
+
+		tree := buildMultiTree(makeTestFs(), []string{"/tmp/a", "/tmp/b"}, &opts)
+
+		root := tree.Root
+		if root.Info.Type != PathTypeMulti || root.Info.Path != "" || root.Info.Basename != MultiRootBasename {
+			t.Fatal("The root should be the synthetic root but is", root.Info)
+		}
+		if len(root.Children) != 2 {
+			t.Fatal("The synthetic root should have 2 children but has", len(root.Children))
+		}
+		if root.Info.Size != 65 || root.Info.Files != 4 || !root.Info.SizeAccurate {
+			t.Fatal("The synthetic root should have an accurate size of 65 in 4 files but has", root.Info)
+		}
+
+		a, b := childWithBasename(root, "a"), childWithBasename(root, "b")
+		if a == nil || a.Info.Path != "/tmp/a" || a.Info.Size != 30 {
+			t.Fatal("The root /tmp/a should have size 30 but is", a)
+		}
+		if b == nil || b.Info.Path != "/tmp/b" || b.Info.Size != 35 {
+			t.Fatal("The root /tmp/b should have size 35 but is", b)
+		}
+
+		if n := tree.Find("/tmp/b/dir/blort"); n == nil || n.Info.Size != 30 {
+			t.Fatal("Finding /tmp/b/dir/blort should return the file of size 30 but returned", n)
+		}
+		if n := tree.Find("/tmp/b"); n != b {
+			t.Fatal("Finding /tmp/b should return the root /tmp/b but returned", n)
+		}
+		if n := tree.Find("/tmp/c"); n != nil {
+			t.Fatal("Finding /tmp/c should return nil but returned", n)
+		}
+		if n := tree.BuildRoot("/tmp/a/file1.txt"); n != a {
+			t.Fatal("The build root of /tmp/a/file1.txt should be /tmp/a but is", n)
+		}
+	}
+}
+
+// noDeviceFs is a TestFs on which the device of the path missing can't be found.
+type noDeviceFs struct {
+	TestFs
+	missing string
+}
+
+func (f noDeviceFs) DeviceId(path string) (uint64, error) {
+	if path == f.missing {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return 0, nil
+}
+
+func TestBuildMultiMissingRoot(t *testing.T) {
+	opts := *DefaultBuildOpts
+	fs := noDeviceFs{makeTestFs(), "/tmp/gone"}
+
+	tree := buildMultiTree(fs, []string{"/tmp/gone", "/tmp/b"}, &opts)
+
+	gone := childWithBasename(tree.Root, "gone")
+	if gone == nil || gone.Info.SizeAccurate || len(gone.Info.Errors) != 1 || gone.Info.Errors[0].Kind != ErrorVanished {
+		t.Fatal("The missing root should be inaccurate with an error but is", gone)
+	}
+	if b := childWithBasename(tree.Root, "b"); b == nil || b.Info.Size != 35 || !b.Info.SizeAccurate {
+		t.Fatal("The root /tmp/b should have an accurate size of 35 but is", b)
+	}
+	if tree.Root.Info.SizeAccurate {
+		t.Fatal("The synthetic root should be inaccurate")
+	}
+}
+
+func TestBuildMultiCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ops := make(chan OpData)
+	go buildMulti(ctx, makeTestFs(), []string{"/tmp/a", "/tmp/b"}, ops, nil, DefaultBuildOpts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+	if tree.Root != nil && tree.Root.Info.SizeAccurate {
+		t.Fatal("A cancelled build should not be accurate")
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"io"
 )
 
-func Encode(opsW io.Writer, progW io.Writer, ops chan OpData, prog chan string) {
+func Encode(opsW io.Writer, progW io.Writer, ops chan OpData, prog chan Progress) {
 	opEnc := gob.NewEncoder(opsW)
 	progEnc := gob.NewEncoder(progW)
 
@@ -38,7 +38,7 @@ loop:
 	}
 }
 
-func Decode(opsR io.Reader, progR io.Reader, ops chan OpData, prog chan string) {
+func Decode(opsR io.Reader, progR io.Reader, ops chan OpData, prog chan Progress) {
 	opDec := gob.NewDecoder(opsR)
 	progDec := gob.NewDecoder(progR)
 
@@ -61,8 +61,8 @@ func Decode(opsR io.Reader, progR io.Reader, ops chan OpData, prog chan string)
 	go func() {
 		defer close(prog)
 
-		var f string
 		for {
+			var f Progress
 			if err := progDec.Decode(&f); err != nil {
 				fmt.Println("Error decoding progress:", err)
 				return
@@ -0,0 +1,72 @@
+package dirtree
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	sent := []OpData{
+		{Op: Push, Path: "/tmp", Basename: "tmp", SizeAccurate: true},
+		{Op: Pop},
+		{Op: Error, Path: "/tmp/x", Err: &ScanError{Path: "/tmp/x", Kind: ErrorPermission, Msg: "denied"}},
+		{Op: AddSize, Size: 10, AllocSize: 4096, Times: Times{NewestMtime: time.Unix(1000, 0)}},
+	}
+
+	ops := make(chan OpData)
+	prog := make(chan Progress)
+	go func() {
+		for _, op := range sent {
+			ops <- op
+		}
+		close(ops)
+		prog <- Progress{Dirs: 1, Files: 2, Bytes: 10, Elapsed: time.Second, Path: "/tmp", DirsPerSec: 1, BytesPerSec: 10}
+		close(prog)
+	}()
+
+	var opsBuf, progBuf bytes.Buffer
+	Encode(&opsBuf, &progBuf, ops, prog)
+
+	ops = make(chan OpData)
+	prog = make(chan Progress)
+	Decode(&opsBuf, &progBuf, ops, prog)
+
+	var progress []Progress
+	progDone := make(chan struct{})
+	go func() {
+		for p := range prog {
+			progress = append(progress, p)
+		}
+		close(progDone)
+	}()
+
+	var received []OpData
+	for op := range ops {
+		received = append(received, op)
+	}
+
+	if len(received) != len(sent) {
+		t.Fatal("Sent", len(sent), "operations but received", len(received))
+	}
+
+	for i, op := range received {
+		if op.Op != sent[i].Op || op.Path != sent[i].Path || op.Size != sent[i].Size || op.AllocSize != sent[i].AllocSize {
+			t.Fatal("Operation", i, "was", op, "but should be", sent[i])
+		}
+	}
+
+	if !received[3].NewestMtime.Equal(sent[3].NewestMtime) {
+		t.Fatal("AddSize operation lost its times:", received[3].Times)
+	}
+
+	<-progDone
+	if len(progress) != 1 || progress[0].Path != "/tmp" || progress[0].Bytes != 10 || progress[0].Elapsed != time.Second {
+		t.Fatal("Progress should be received intact but was", progress)
+	}
+
+	e := received[2].Err
+	if e == nil || *e != *sent[2].Err {
+		t.Fatal("Error operation lost its error:", e)
+	}
+}
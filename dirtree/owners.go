@@ -0,0 +1,117 @@
+package dirtree
+
+import (
+	"os"
+	"sort"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// OwnerHistogram holds the totals of the files owned by each user or group id at or under a path.
+// Ids without files are left out.
+type OwnerHistogram map[uint32]TypeTotals
+
+// add adds the totals t to the id, and returns the histogram, which is allocated if h is nil.
+func (h OwnerHistogram) add(id uint32, t TypeTotals) OwnerHistogram {
+	if h == nil {
+		h = make(OwnerHistogram)
+	}
+
+	v := h[id]
+	v.Size += t.Size
+	v.AllocSize += t.AllocSize
+	v.Files += t.Files
+	if v == (TypeTotals{}) {
+		delete(h, id)
+	} else {
+		h[id] = v
+	}
+	return h
+}
+
+// merge adds the totals in o to h, and returns the histogram. It's nil if no ids are left, and
+// is never o itself.
+func (h OwnerHistogram) merge(o OwnerHistogram) OwnerHistogram {
+	for id, t := range o {
+		h = h.add(id, t)
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// neg returns a histogram holding the negation of the totals in h.
+func (h OwnerHistogram) neg() OwnerHistogram {
+	var n OwnerHistogram
+	for id, t := range h {
+		n = n.add(id, TypeTotals{-t.Size, -t.AllocSize, -t.Files})
+	}
+	return n
+}
+
+// clone returns a copy of h.
+func (h OwnerHistogram) clone() OwnerHistogram {
+	return OwnerHistogram(nil).merge(h)
+}
+
+// fileOwner is the owner of a file, if owners are recorded.
+type fileOwner struct {
+	uid, gid uint32
+	ok       bool
+}
+
+// owner returns the owner of the file fi, if the build records owners and the owner is known.
+func (r *dirReader) owner(fi os.FileInfo) fileOwner {
+	if !r.opts.Owners {
+		return fileOwner{}
+	}
+	uid, gid, err := sh.GetOwner(fi)
+	return fileOwner{uid, gid, err == nil}
+}
+
+// addTo adds the totals t of a file owned by o to the histograms of users and groups.
+func (o fileOwner) addTo(users, groups *OwnerHistogram, t TypeTotals) {
+	if o.ok {
+		*users = users.add(o.uid, t)
+		*groups = groups.add(o.gid, t)
+	}
+}
+
+// OwnerCount is a user or group id and the totals of the files it owns.
+type OwnerCount struct {
+	Id uint32
+	TypeTotals
+}
+
+// TopUsers returns the users that own the files under the node, from largest to smallest in the
+// SizeMode m. At most count users are returned, unless count is not positive. Nothing is returned for
+// the nodes of files, or if the build didn't record owners.
+func (n *Node) TopUsers(count int, m SizeMode) []OwnerCount {
+	return topOwners(n.Info.Users, count, m)
+}
+
+// TopGroups is like TopUsers, but for the groups that own the files.
+func (n *Node) TopGroups(count int, m SizeMode) []OwnerCount {
+	return topOwners(n.Info.Groups, count, m)
+}
+
+func topOwners(h OwnerHistogram, count int, m SizeMode) []OwnerCount {
+	owners := make([]OwnerCount, 0, len(h))
+	for id, t := range h {
+		owners = append(owners, OwnerCount{id, t})
+	}
+
+	sort.Slice(owners, func(i, j int) bool {
+		si, sj := owners[i].SizeIn(m), owners[j].SizeIn(m)
+		if si != sj {
+			return si > sj
+		}
+		return owners[i].Id < owners[j].Id
+	})
+
+	if count > 0 && len(owners) > count {
+		owners = owners[:count]
+	}
+	return owners
+}
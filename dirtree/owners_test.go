@@ -0,0 +1,65 @@
+package dirtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildOwners(t *testing.T) {
+	owned := func(name string, size int64, uid, gid uint32) TestFileInfo {
+		fi := NewTestFileInfo(name, false, size)
+		fi.uid, fi.gid = uid, gid
+		return fi
+	}
+
+	link := func(name string) TestFileInfo {
+		fi := owned(name, 100, 1000, 100)
+		fi.ino = 5
+		fi.nlink = 2
+		return fi
+	}
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp":   TestFile{NewTestFileInfo("a", true, 0), NewTestFileInfo("b", true, 0), owned("c", 1, 5, 5)},
+			"/tmp/a": TestFile{link("x"), owned("y", 10, 1001, 100)},
+			"/tmp/b": TestFile{link("z"), owned("w", 20, 1001, 101)},
+		},
+	}
+
+	for _, mode := range []HardLinkMode{HardLinksCountAll, HardLinksFirstPath, HardLinksShared} {
+		for _, includeFiles := range []bool{false, true} {
+			opts := *DefaultBuildOpts
+			opts.HardLinks = mode
+			opts.IncludeFiles = includeFiles
+			opts.Owners = true
+			tree := buildIncrementalTree(fs, &opts)
+
+			links := int64(100)
+			if mode == HardLinksCountAll {
+				links = 200
+			}
+
+			expected := []OwnerCount{{1000, TypeTotals{Size: links, Files: 2}}, {1001, TypeTotals{Size: 30, Files: 2}}, {5, TypeTotals{Size: 1, Files: 1}}}
+			if users := tree.Root.TopUsers(0, SizeModeApparent); !reflect.DeepEqual(users, expected) {
+				t.Fatal("In mode", mode, "with files", includeFiles, "root should have users", expected, "but has", users)
+			}
+
+			expected = []OwnerCount{{100, TypeTotals{Size: links + 10, Files: 3}}}
+			if groups := tree.Root.TopGroups(1, SizeModeApparent); !reflect.DeepEqual(groups, expected) {
+				t.Fatal("In mode", mode, "with files", includeFiles, "root should have top group", expected, "but has", groups)
+			}
+
+			b := childWithBasename(tree.Root, "b")
+			if users := b.TopUsers(0, SizeModeEntries); len(users) != 2 || users[0].Files != 1 || users[1].Files != 1 {
+				t.Fatal("In mode", mode, "with files", includeFiles, "b should have two users with one file each, but has", users)
+			}
+		}
+	}
+
+	// Owners are not recorded unless asked for.
+	tree := buildIncrementalTree(fs, DefaultBuildOpts)
+	if tree.Root.Info.Users != nil || tree.Root.Info.Groups != nil {
+		t.Fatal("Owners should not be recorded by default")
+	}
+}
@@ -0,0 +1,114 @@
+package dirtree
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// Progress reports how far a build has got. Builds write it to their progress channel after reading
+// each directory, and now and then while processing a large directory.
+type Progress struct {
+	// Dirs is the number of directories read, and Files the number of files seen in them.
+	Dirs, Files int64
+	// Bytes is the size of the files seen: the apparent size, or the allocated size if the build only
+	// counts allocated sizes.
+	Bytes int64
+	// Errors is the number of paths that couldn't be read.
+	Errors int64
+	// Elapsed is the time since the build started.
+	Elapsed time.Duration
+	// Path is the path being processed.
+	Path string
+	// DirsPerSec and BytesPerSec estimate the throughput of the build, averaged since it started.
+	DirsPerSec, BytesPerSec float64
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("%d dirs, %d files, %s in %v (%.0f dirs/s, %s/s)", p.Dirs, p.Files, sh.FancySize(p.Bytes),
+		p.Elapsed.Truncate(time.Second), p.DirsPerSec, sh.FancySize(int64(p.BytesPerSec)))
+	if p.Errors > 0 {
+		s += fmt.Sprintf(", %d errors", p.Errors)
+	}
+	if p.Path != "" {
+		s += ": " + p.Path
+	}
+	return s
+}
+
+// plus returns the counts of p and o added up. The other fields are those of p.
+func (p Progress) plus(o Progress) Progress {
+	p.Dirs += o.Dirs
+	p.Files += o.Files
+	p.Bytes += o.Bytes
+	p.Errors += o.Errors
+	return p
+}
+
+// setElapsed sets the elapsed time of p to the time since start, and the throughput accordingly.
+func (p *Progress) setElapsed(start time.Time) {
+	p.Elapsed = time.Since(start)
+	p.DirsPerSec, p.BytesPerSec = 0, 0
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.DirsPerSec = float64(p.Dirs) / secs
+		p.BytesPerSec = float64(p.Bytes) / secs
+	}
+}
+
+// progressCounter counts the directories processed by a build, for its Progress reports.
+type progressCounter struct {
+	counts Progress
+	start  time.Time
+	mode   SizeMode
+}
+
+func newProgressCounter(m SizeMode) *progressCounter {
+	return &progressCounter{start: time.Now(), mode: m}
+}
+
+// listing counts the directory listing l once its hard links are counted.
+func (c *progressCounter) listing(l *dirListing) {
+	c.counts.Dirs++
+	c.counts.Files += l.files
+	c.counts.Bytes += c.bytes(l.size, l.allocSize)
+	c.counts.Errors += int64(len(l.errors))
+	for i := range l.entries {
+		op := &l.entries[i]
+		c.counts.Files += op.Files
+		c.counts.Bytes += c.bytes(op.Size, op.AllocSize)
+	}
+}
+
+// bytes returns the size counted in the progress of a file or directory with the sizes given.
+func (c *progressCounter) bytes(size, allocSize int64) int64 {
+	return progressBytes(c.mode, size, allocSize)
+}
+
+// progressBytes returns the size counted in the progress of a build in the SizeMode m of a file or
+// directory with the sizes given.
+func progressBytes(m SizeMode, size, allocSize int64) int64 {
+	if m == SizeModeAllocated {
+		return allocSize
+	}
+	return size
+}
+
+// report returns the progress of the build while processing path.
+func (c *progressCounter) report(path string) Progress {
+	p := c.counts
+	p.Path = path
+	p.setElapsed(c.start)
+	return p
+}
+
+// reading returns the progress of the build while the directory listing l is read, including the
+// files found in it so far.
+func (c *progressCounter) reading(l *dirListing) Progress {
+	p := c.report(l.path)
+	p.Files += atomic.LoadInt64(&l.readFiles)
+	p.Bytes += atomic.LoadInt64(&l.readBytes)
+	p.setElapsed(c.start)
+	return p
+}
@@ -0,0 +1,56 @@
+package dirtree
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// lastProgress applies the operations from ops to a new tree, and returns the last progress from prog.
+func lastProgress(ops chan OpData, prog chan Progress) Progress {
+	var last Progress
+	done := make(chan struct{})
+	go func() {
+		for p := range prog {
+			last = p
+		}
+		close(done)
+	}()
+
+	New().ApplyAll(ops)
+	<-done
+	return last
+}
+
+func TestBuildProgress(t *testing.T) {
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+
+		p := lastProgress(BuildFsContext(context.Background(), makeTestFs(), "/tmp", &opts))
+		if p.Dirs != 4 || p.Files != 4 || p.Bytes != 65 || p.Errors != 0 {
+			t.Fatal("The build of /tmp should read 4 directories and 4 files of 65 bytes but progressed", p)
+		}
+		if p.Path == "" || p.Elapsed <= 0 || p.DirsPerSec <= 0 || p.BytesPerSec <= 0 {
+			t.Fatal("The progress should have a path, elapsed time and throughput but is", p)
+		}
+	}
+
+	ops := make(chan OpData)
+	prog := make(chan Progress)
+	go buildMulti(context.Background(), makeTestFs(), []string{"/tmp/a", "/tmp/b", "/tmp/gone"}, ops, prog, DefaultBuildOpts)
+	p := lastProgress(ops, prog)
+	if p.Dirs != 4 || p.Files != 4 || p.Bytes != 65 || p.Errors != 1 {
+		t.Fatal("The build of the roots should read 4 directories and 4 files of 65 bytes with 1 error but progressed", p)
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	p := Progress{Dirs: 3, Files: 10, Bytes: 2048, Errors: 1, Path: "/tmp/a", DirsPerSec: 3, BytesPerSec: 2048}
+	s := p.String()
+	for _, v := range []string{"3 dirs", "10 files", "2.0KB", "1 errors", "/tmp/a"} {
+		if !strings.Contains(s, v) {
+			t.Fatal("The progress", s, "should contain", v)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package dirtree
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A snapshot starts with snapshotMagic and the format version as a uvarint. The rest is gzip compressed,
+// and holds the nodes of the tree in pre-order. Each node is written as:
+//
+//	flags       byte: flagAccurate, flagPath and one flag for each of the times present
+//	path        string, only if flagPath is set; otherwise the path is the parent's path joined with the basename
+//	basename    string
+//	type        byte
+//	fsType      string, only for nodes of type PathTypeMount
+//	size, allocSize, sharedSize, files, dirs, other   varints
+//	times       varint nanoseconds since the epoch, for each time that is present, in the order
+//	            NewestMtime, OldestMtime, NewestAtime, OldestAtime, ModTime, ChangeTime
+//	layer       varint
+//	types       uvarint count, then the type string and size, allocSize and files varints for each type
+//	users       uvarint count, then the id uvarint and size, allocSize and files varints for each user
+//	groups      the same as users, for each group
+//	sparse      uvarint count, then basename string, kind byte and size, allocSize and dataSize varints for each file
+//	errors      uvarint count, then path string, kind byte and message string for each error
+//	children    uvarint count, followed by the children
+//
+// Strings are written as a uvarint length followed by the bytes.
+const (
+	snapshotMagic   = "SPHSNAP\n"
+	snapshotVersion = 1
+)
+
+const (
+	flagAccurate = 1 << iota
+	flagPath
+	flagNewestMtime
+	flagOldestMtime
+	flagNewestAtime
+	flagOldestAtime
+	flagModTime
+	flagChangeTime
+)
+
+// ErrBadSnapshot is returned by Load when the data is not a snapshot written by Save.
+var ErrBadSnapshot = errors.New("not a snapshot")
+
+// snapshotWriter writes the fields of a snapshot, remembering the first error.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (s *snapshotWriter) write(b []byte) {
+	if s.err == nil {
+		_, s.err = s.w.Write(b)
+	}
+}
+
+func (s *snapshotWriter) byte(b byte) {
+	if s.err == nil {
+		s.err = s.w.WriteByte(b)
+	}
+}
+
+func (s *snapshotWriter) uvarint(v uint64) {
+	s.write(s.buf[:binary.PutUvarint(s.buf[:], v)])
+}
+
+func (s *snapshotWriter) varint(v int64) {
+	s.write(s.buf[:binary.PutVarint(s.buf[:], v)])
+}
+
+func (s *snapshotWriter) string(v string) {
+	s.uvarint(uint64(len(v)))
+	if s.err == nil {
+		_, s.err = s.w.WriteString(v)
+	}
+}
+
+func (s *snapshotWriter) node(n *Node, parentPath string) {
+	info := &n.Info
+	times := []time.Time{info.NewestMtime, info.OldestMtime, info.NewestAtime, info.OldestAtime, info.ModTime, info.ChangeTime}
+
+	var flags byte
+	if info.SizeAccurate {
+		flags |= flagAccurate
+	}
+	if n.Parent == nil || info.Path != parentPath+string(os.PathSeparator)+info.Basename {
+		flags |= flagPath
+	}
+	for i, t := range times {
+		if !t.IsZero() {
+			flags |= flagNewestMtime << i
+		}
+	}
+
+	s.byte(flags)
+	if flags&flagPath != 0 {
+		s.string(info.Path)
+	}
+	s.string(info.Basename)
+	s.byte(byte(info.Type))
+	if info.Type == PathTypeMount {
+		s.string(info.FsType)
+	}
+	for _, v := range []int64{info.Size, info.AllocSize, info.SharedSize, info.Files, info.Dirs, info.Other} {
+		s.varint(v)
+	}
+	for _, t := range times {
+		if !t.IsZero() {
+			s.varint(t.UnixNano())
+		}
+	}
+	s.varint(int64(info.Layer))
+
+	// Sort the types so that the same tree is always saved the same way.
+	types := make([]string, 0, len(info.Types))
+	for typ := range info.Types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	s.uvarint(uint64(len(types)))
+	for _, typ := range types {
+		t := info.Types[typ]
+		s.string(typ)
+		s.varint(t.Size)
+		s.varint(t.AllocSize)
+		s.varint(t.Files)
+	}
+	s.owners(info.Users)
+	s.owners(info.Groups)
+
+	s.uvarint(uint64(len(info.Sparse)))
+	for _, f := range info.Sparse {
+		s.string(filepath.Base(f.Path))
+		s.byte(byte(f.Kind))
+		s.varint(f.Size)
+		s.varint(f.AllocSize)
+		s.varint(f.DataSize)
+	}
+
+	s.uvarint(uint64(len(info.Errors)))
+	for _, e := range info.Errors {
+		s.string(e.Path)
+		s.byte(byte(e.Kind))
+		s.string(e.Msg)
+	}
+
+	s.uvarint(uint64(len(n.Children)))
+	for _, c := range n.Children {
+		s.node(c, info.Path)
+	}
+}
+
+// owners writes the histogram h, sorted by id.
+func (s *snapshotWriter) owners(h OwnerHistogram) {
+	ids := make([]int, 0, len(h))
+	for id := range h {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	s.uvarint(uint64(len(ids)))
+	for _, id := range ids {
+		t := h[uint32(id)]
+		s.uvarint(uint64(id))
+		s.varint(t.Size)
+		s.varint(t.AllocSize)
+		s.varint(t.Files)
+	}
+}
+
+// Save writes the tree to w in a compact binary format that Load can read. The tree must not be modified
+// while it's being saved. The UserData of the nodes is not saved.
+func (t *Dirtree) Save(w io.Writer) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], snapshotVersion)]); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	s := &snapshotWriter{w: bufio.NewWriter(gz)}
+
+	if t.Root != nil {
+		s.byte(1)
+		s.node(t.Root, "")
+	} else {
+		s.byte(0)
+	}
+
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	return gz.Close()
+}
+
+// snapshotReader reads the fields of a snapshot, remembering the first error.
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (s *snapshotReader) byte() byte {
+	if s.err != nil {
+		return 0
+	}
+	var b byte
+	b, s.err = s.r.ReadByte()
+	return b
+}
+
+func (s *snapshotReader) uvarint() uint64 {
+	if s.err != nil {
+		return 0
+	}
+	var v uint64
+	v, s.err = binary.ReadUvarint(s.r)
+	return v
+}
+
+func (s *snapshotReader) varint() int64 {
+	if s.err != nil {
+		return 0
+	}
+	var v int64
+	v, s.err = binary.ReadVarint(s.r)
+	return v
+}
+
+// maxSnapshotCount limits the counts read from a snapshot, so that corrupt data doesn't cause huge allocations.
+const maxSnapshotCount = 1 << 24
+
+// count reads the number of items or bytes that follow.
+func (s *snapshotReader) count() int {
+	v := s.uvarint()
+	if v > maxSnapshotCount {
+		s.err = ErrBadSnapshot
+		return 0
+	}
+	return int(v)
+}
+
+func (s *snapshotReader) string() string {
+	l := s.count()
+	if s.err != nil {
+		return ""
+	}
+	b := make([]byte, l)
+	_, s.err = io.ReadFull(s.r, b)
+	return string(b)
+}
+
+func (s *snapshotReader) node(parent *Node) *Node {
+	n := &Node{Parent: parent}
+	info := &n.Info
+
+	flags := s.byte()
+	info.SizeAccurate = flags&flagAccurate != 0
+	if flags&flagPath != 0 {
+		info.Path = s.string()
+	}
+	info.Basename = s.string()
+	if flags&flagPath == 0 && parent != nil {
+		info.Path = parent.Info.Path + string(os.PathSeparator) + info.Basename
+	}
+	info.Type = PathType(s.byte())
+	if info.Type == PathTypeMount {
+		info.FsType = s.string()
+	}
+	for _, v := range []*int64{&info.Size, &info.AllocSize, &info.SharedSize, &info.Files, &info.Dirs, &info.Other} {
+		*v = s.varint()
+	}
+	for i, t := range []*time.Time{&info.NewestMtime, &info.OldestMtime, &info.NewestAtime, &info.OldestAtime, &info.ModTime, &info.ChangeTime} {
+		if flags&(flagNewestMtime<<i) != 0 {
+			*t = time.Unix(0, s.varint())
+		}
+	}
+	info.Layer = int(s.varint())
+
+	for i, c := 0, s.count(); i < c && s.err == nil; i++ {
+		typ := s.string()
+		info.Types = info.Types.add(typ, TypeTotals{s.varint(), s.varint(), s.varint()})
+	}
+	info.Users = s.owners()
+	info.Groups = s.owners()
+	for i, c := 0, s.count(); i < c && s.err == nil; i++ {
+		f := &SparseFile{Path: info.Path + string(os.PathSeparator) + s.string(), Kind: SparseKind(s.byte())}
+		f.Size, f.AllocSize, f.DataSize = s.varint(), s.varint(), s.varint()
+		info.Sparse = append(info.Sparse, f)
+	}
+
+	for i, c := 0, s.count(); i < c && s.err == nil; i++ {
+		e := &ScanError{Path: s.string(), Kind: ErrorKind(s.byte()), Msg: s.string()}
+		info.Errors = append(info.Errors, e)
+	}
+
+	for i, c := 0, s.count(); i < c && s.err == nil; i++ {
+		n.Children = append(n.Children, s.node(n))
+	}
+	return n
+}
+
+// owners reads a histogram written by snapshotWriter.owners.
+func (s *snapshotReader) owners() OwnerHistogram {
+	var h OwnerHistogram
+	for i, c := 0, s.count(); i < c && s.err == nil; i++ {
+		id := uint32(s.uvarint())
+		h = h.add(id, TypeTotals{s.varint(), s.varint(), s.varint()})
+	}
+	return h
+}
+
+// Load reads a tree written by Dirtree.Save. The children of the nodes are in the same order as when
+// the tree was saved, and are not sorted.
+func Load(r io.Reader) (*Dirtree, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, ErrBadSnapshot
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrBadSnapshot
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	s := &snapshotReader{r: bufio.NewReader(gz)}
+	t := New()
+	if s.byte() == 1 {
+		t.Root = s.node(nil)
+	}
+
+	// Reach the end of the compressed data so that its checksum is verified.
+	if s.err == nil {
+		if _, err := s.r.ReadByte(); err == nil {
+			s.err = ErrBadSnapshot
+		} else if err != io.EOF {
+			s.err = err
+		}
+	}
+
+	if s.err == io.EOF || s.err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("Snapshot is truncated")
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return t, nil
+}
+
+// Replay writes operations to ops that build a copy of the tree t when applied to an empty Dirtree,
+// then closes ops. The tree must not be modified while it's being replayed.
+func (t *Dirtree) Replay(ops chan OpData) {
+	defer close(ops)
+
+	if t.Root == nil {
+		return
+	}
+
+	root := &t.Root.Info
+	if !root.Type.isDirLike() {
+		ops <- OpData{Op: Push, Path: root.Path, Basename: root.Basename, SizeAccurate: true, Type: root.Type, Size: root.Size, AllocSize: root.AllocSize,
+			SharedSize: root.SharedSize, Files: root.Files, Dirs: root.Dirs, Other: root.Other, Layer: root.Layer, Types: root.Types,
+			Users: root.Users, Groups: root.Groups, FsType: root.FsType, Times: root.Times}
+		return
+	}
+	ops <- OpData{Op: Push, Path: root.Path, Basename: root.Basename, SizeAccurate: true, Type: root.Type}
+
+	// The order of the work must match the order in which ApplyCtx pops nodes.
+	work := []*Node{t.Root}
+	for len(work) > 0 {
+		n := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		ops <- OpData{Op: Pop}
+
+		// The size that belongs to n itself, rather than its children.
+		own := n.Info
+		own.Types = own.Types.clone()
+		own.Users, own.Groups = own.Users.clone(), own.Groups.clone()
+		for _, c := range n.Children {
+			ci := &c.Info
+			op := OpData{Op: Push, Path: ci.Path, Basename: ci.Basename, SizeAccurate: true, Type: ci.Type}
+			if ci.Type.isDirLike() {
+				work = append(work, c)
+			} else {
+				op.Size, op.AllocSize, op.SharedSize = ci.Size, ci.AllocSize, ci.SharedSize
+				op.Files, op.Dirs, op.Other = ci.Files, ci.Dirs, ci.Other
+				op.Layer, op.Types, op.Times = ci.Layer, ci.Types, ci.Times
+				op.Users, op.Groups = ci.Users, ci.Groups
+				op.FsType = ci.FsType
+			}
+			ops <- op
+			own.addTotals(ci.negTotals())
+		}
+
+		for _, e := range n.Info.Errors {
+			ops <- OpData{Op: Error, Path: e.Path, Err: e}
+		}
+
+		ops <- OpData{Op: AddSize, Size: own.Size, AllocSize: own.AllocSize, SharedSize: own.SharedSize, Files: own.Files, Dirs: own.Dirs,
+			Other: own.Other, Layer: n.Info.Layer, Types: own.Types, Users: own.Users, Groups: own.Groups, Sparse: n.Info.Sparse, Times: n.Info.Times, SizeAccurate: n.Info.SizeAccurate,
+			ModTime: n.Info.ModTime, ChangeTime: n.Info.ChangeTime}
+	}
+}
@@ -0,0 +1,92 @@
+package dirtree
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// compareNodes fails the test if the nodes a and b and their descendants don't hold the same information.
+func compareNodes(t *testing.T, a, b *Node) {
+	ai, bi := a.Info, b.Info
+	for _, p := range [][2]*time.Time{{&ai.NewestMtime, &bi.NewestMtime}, {&ai.OldestMtime, &bi.OldestMtime},
+		{&ai.NewestAtime, &bi.NewestAtime}, {&ai.OldestAtime, &bi.OldestAtime}, {&ai.ModTime, &bi.ModTime}, {&ai.ChangeTime, &bi.ChangeTime}} {
+		if !p[0].Equal(*p[1]) {
+			t.Fatal("Path", ai.Path, "has times", *p[0], "and", *p[1])
+		}
+		*p[0], *p[1] = time.Time{}, time.Time{}
+	}
+
+	if !reflect.DeepEqual(ai, bi) {
+		t.Fatalf("Path %s has information %+v and %+v", ai.Path, ai, bi)
+	}
+	if len(a.Children) != len(b.Children) {
+		t.Fatal("Path", ai.Path, "has", len(a.Children), "and", len(b.Children), "children")
+	}
+	for i := range a.Children {
+		if b.Children[i].Parent != b {
+			t.Fatal("Path", b.Children[i].Info.Path, "has the wrong parent")
+		}
+		compareNodes(t, a.Children[i], b.Children[i])
+	}
+}
+
+func makeSnapshotTree() *Dirtree {
+	fs := makeTestFs()
+	fs.Files["/tmp/b"] = append(fs.Files["/tmp/b"], TestFileInfo{name: "old", size: 3, mtime: time.Unix(1000, 0), uid: 1000, gid: 100})
+	fs.Files["/tmp/b"] = append(fs.Files["/tmp/b"], TestFileInfo{name: "disk.img", size: 10 << 20, blocks: 8})
+
+	opts := *DefaultBuildOpts
+	opts.IncludeFiles = true
+	opts.SizeMode = SizeModeBoth
+	opts.FileTypes = FileTypesExtension
+	opts.Owners = true
+	opts.Sparse = DefaultSparseOpts
+
+	ops := make(chan OpData)
+	go build(fs, "/tmp", ops, nil, &opts)
+
+	tree := New()
+	tree.ApplyAll(ops)
+
+	// A node with an error.
+	a := tree.Root.Children[0]
+	a.Info.Errors = []*ScanError{{Path: a.Info.Path + "/secret", Kind: ErrorPermission, Msg: "permission denied"}}
+	a.addSize(&PathInfo{}, false)
+	return tree
+}
+
+func TestSaveLoad(t *testing.T) {
+	tree := makeSnapshotTree()
+
+	var buf bytes.Buffer
+	if err := tree.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareNodes(t, tree.Root, loaded.Root)
+
+	// Truncated data is detected.
+	if _, err := Load(bytes.NewReader(buf.Bytes()[:buf.Len()-10])); err == nil {
+		t.Fatal("Loading a truncated snapshot should fail")
+	}
+	if _, err := Load(bytes.NewReader([]byte("not a snapshot at all"))); err != ErrBadSnapshot {
+		t.Fatal("Loading something else should fail with ErrBadSnapshot but got", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tree := makeSnapshotTree()
+
+	ops := make(chan OpData)
+	go tree.Replay(ops)
+
+	replayed := New()
+	replayed.ApplyAll(ops)
+	compareNodes(t, tree.Root, replayed.Root)
+}
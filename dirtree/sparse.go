@@ -0,0 +1,116 @@
+package dirtree
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// SparseKind is the way in which the allocated size of a file differs from its apparent size.
+type SparseKind uint8
+
+const (
+	// SparseHoles is a file with much less allocated than its apparent size, because it has holes.
+	SparseHoles SparseKind = iota
+	// SparsePreallocated is a file with much more allocated than its apparent size, such as one
+	// preallocated with fallocate but not yet written.
+	SparsePreallocated
+)
+
+var sparseKindNames = []string{"holes", "preallocated"}
+
+func (k SparseKind) String() string {
+	if int(k) < len(sparseKindNames) {
+		return sparseKindNames[k]
+	}
+	return fmt.Sprintf("SparseKind(%d)", k)
+}
+
+// SparseOpts selects the files whose allocated size differs a lot from their apparent size.
+type SparseOpts struct {
+	// MinDiff is the least number of bytes by which the sizes must differ.
+	MinDiff int64
+	// Ratio is the least ratio of the larger size to the smaller one.
+	Ratio float64
+	// SeekData measures the data extents of the files found with SEEK_DATA and SEEK_HOLE. It's only
+	// done on the local filesystem, and opens each file that is found.
+	SeekData bool
+}
+
+var DefaultSparseOpts = &SparseOpts{
+	MinDiff: 1 << 20,
+	Ratio:   2,
+}
+
+// SparseFile is a file whose allocated size differs a lot from its apparent size.
+type SparseFile struct {
+	Path string
+	Kind SparseKind
+	// Size is the apparent size of the file, and AllocSize the size allocated for it on disk.
+	Size, AllocSize int64
+	// DataSize is the size of the data extents of the file, or -1 if it was not measured.
+	DataSize int64
+}
+
+// Diff returns the number of bytes by which the sizes of the file differ.
+func (s *SparseFile) Diff() int64 {
+	if s.Size > s.AllocSize {
+		return s.Size - s.AllocSize
+	}
+	return s.AllocSize - s.Size
+}
+
+// sparseFile returns the file fpath described by fi if its allocated size differs a lot from its apparent
+// size, and the build looks for such files. Otherwise it returns nil.
+func (r *dirReader) sparseFile(fpath string, fi os.FileInfo) *SparseFile {
+	o := r.opts.Sparse
+	if o == nil {
+		return nil
+	}
+
+	// Only the allocated size on disk is compared, not the size in an archive or image.
+	allocSize, err := sh.GetAllocatedSize(fi)
+	if err != nil {
+		return nil
+	}
+	size := fi.Size()
+
+	s := &SparseFile{Path: fpath, Size: size, AllocSize: allocSize, DataSize: -1}
+	switch {
+	case size-allocSize >= o.MinDiff && float64(allocSize)*o.Ratio <= float64(size):
+		s.Kind = SparseHoles
+	case allocSize-size >= o.MinDiff && float64(size)*o.Ratio <= float64(allocSize):
+		s.Kind = SparsePreallocated
+	default:
+		return nil
+	}
+
+	if _, ok := r.fs.(OsFilesystem); ok && o.SeekData {
+		if data, err := sh.GetDataSize(fpath); err == nil {
+			s.DataSize = data
+		}
+	}
+	return s
+}
+
+// SparseFiles returns the files at or under the node whose allocated size differs a lot from their
+// apparent size, from the largest difference to the smallest. Nothing is returned unless the tree
+// was built with BuildOpts.Sparse.
+func (n *Node) SparseFiles() []*SparseFile {
+	var files []*SparseFile
+	n.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		files = append(files, n.Info.Sparse...)
+		return true, false
+	}, 0)
+
+	sort.Slice(files, func(i, j int) bool {
+		di, dj := files[i].Diff(), files[j].Diff()
+		if di != dj {
+			return di > dj
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
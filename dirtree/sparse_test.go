@@ -0,0 +1,60 @@
+package dirtree
+
+import (
+	"testing"
+)
+
+func TestBuildSparse(t *testing.T) {
+	allocated := func(name string, size, blocks int64) TestFileInfo {
+		fi := NewTestFileInfo(name, false, size)
+		fi.blocks = blocks
+		return fi
+	}
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp": TestFile{NewTestFileInfo("a", true, 0), allocated("disk.img", 10<<20, 8)},
+			// A database file preallocated to 4MB, one sparse but too small to count, and one that is only a
+			// little sparse.
+			"/tmp/a": TestFile{allocated("db", 1000, 8192), allocated("small", 10000, 8), allocated("full", 3<<20, 4096)},
+		},
+	}
+
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+		opts.Sparse = DefaultSparseOpts
+		tree := buildIncrementalTree(fs, &opts)
+
+		if len(tree.Root.Info.Sparse) != 1 {
+			t.Fatal("With files", includeFiles, "root should list 1 sparse file but lists", len(tree.Root.Info.Sparse))
+		}
+
+		files := tree.Root.SparseFiles()
+		if len(files) != 2 {
+			t.Fatal("With files", includeFiles, "there should be 2 sparse files but there are", len(files))
+		}
+
+		expected := SparseFile{Path: "/tmp/disk.img", Kind: SparseHoles, Size: 10 << 20, AllocSize: 4096, DataSize: -1}
+		if *files[0] != expected {
+			t.Fatal("With files", includeFiles, "the first sparse file should be", expected, "but is", *files[0])
+		}
+		expected = SparseFile{Path: "/tmp/a/db", Kind: SparsePreallocated, Size: 1000, AllocSize: 4 << 20, DataSize: -1}
+		if *files[1] != expected {
+			t.Fatal("With files", includeFiles, "the second sparse file should be", expected, "but is", *files[1])
+		}
+
+		// The files are replaced when the directory is read again.
+		fs.Files["/tmp/a"] = TestFile{allocated("db", 4<<20, 8192)}
+		tree.ApplyUpdate(ReadDirUpdate(fs, "/tmp", "/tmp/a", &opts))
+		if files := tree.Root.SparseFiles(); len(files) != 1 || files[0].Path != "/tmp/disk.img" {
+			t.Fatal("With files", includeFiles, "only /tmp/disk.img should be sparse after the update, but", files, "are")
+		}
+		fs.Files["/tmp/a"] = TestFile{allocated("db", 1000, 8192), allocated("small", 10000, 8), allocated("full", 3<<20, 4096)}
+	}
+
+	// Nothing is listed unless asked for.
+	if files := buildIncrementalTree(fs, DefaultBuildOpts).Root.SparseFiles(); len(files) != 0 {
+		t.Fatal("Sparse files should not be listed by default, but", files, "are")
+	}
+}
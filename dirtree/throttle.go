@@ -0,0 +1,268 @@
+package dirtree
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// IOClass is an I/O scheduling class of Linux, as set by ionice.
+type IOClass uint8
+
+const (
+	// IOClassNone leaves the I/O priority unchanged.
+	IOClassNone IOClass = iota
+	// IOClassRealtime is served before the other classes. Setting it requires CAP_SYS_ADMIN.
+	IOClassRealtime
+	// IOClassBestEffort is the class of most processes.
+	IOClassBestEffort
+	// IOClassIdle is only served when no other process needs the disk.
+	IOClassIdle
+)
+
+var ioClassNames = []string{"none", "realtime", "best-effort", "idle"}
+
+func (c IOClass) String() string {
+	if int(c) < len(ioClassNames) {
+		return ioClassNames[c]
+	}
+	return fmt.Sprintf("IOClass(%d)", c)
+}
+
+// ParseIOClass returns the IOClass with the name s, as returned by IOClass.String.
+func ParseIOClass(s string) (IOClass, error) {
+	for i, v := range ioClassNames {
+		if v == s {
+			return IOClass(i), nil
+		}
+	}
+	return IOClassNone, fmt.Errorf("Unknown I/O class '%s'. Must be one of none, realtime, best-effort or idle", s)
+}
+
+// ThrottleOpts limit the load that a build puts on the filesystem.
+type ThrottleOpts struct {
+	// DirsPerSec is the most directories read per second, or zero for no limit.
+	DirsPerSec float64
+	// StatsPerSec is the most entries looked up per second, or zero for no limit.
+	StatsPerSec float64
+	// Adaptive slows the build down while reading directories takes much longer than it usually does,
+	// which is a sign that the disks are busy.
+	Adaptive bool
+	// IOClass and IOLevel are the I/O priority of the threads that read the filesystem. The level is from
+	// 0, the highest priority, to 7, and is ignored for IOClassIdle. If the priority can't be set, the
+	// build goes on at the usual priority, so Validate should be used to check it first.
+	IOClass IOClass
+	IOLevel int
+}
+
+// NewThrottleOpts returns the options with the limits given and the I/O class with the name class, or
+// nil if they set no limits. It returns an error if the class is unknown or Validate fails.
+func NewThrottleOpts(dirsPerSec, statsPerSec float64, adaptive bool, class string, level int) (*ThrottleOpts, error) {
+	c, err := ParseIOClass(class)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &ThrottleOpts{DirsPerSec: dirsPerSec, StatsPerSec: statsPerSec, Adaptive: adaptive, IOClass: c, IOLevel: level}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	if dirsPerSec <= 0 && statsPerSec <= 0 && !adaptive && c == IOClassNone {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// Validate returns an error if the I/O priority of the options is not valid, or can't be set by this
+// process, such as IOClassRealtime without CAP_SYS_ADMIN.
+func (o *ThrottleOpts) Validate() error {
+	if o.IOLevel < 0 || o.IOLevel > 7 {
+		return fmt.Errorf("I/O level %d is not between 0 and 7", o.IOLevel)
+	}
+	if int(o.IOClass) >= len(ioClassNames) {
+		return fmt.Errorf("Unknown I/O class %v", o.IOClass)
+	}
+	if o.IOClass == IOClassNone {
+		return nil
+	}
+
+	// The priority is set on a thread that is ended once it's tried.
+	errs := make(chan error)
+	go func() {
+		errs <- lockIOPriority(o)
+	}()
+	if err := <-errs; err != nil {
+		return fmt.Errorf("Setting the I/O priority to %v failed: %v", o.IOClass, err)
+	}
+	return nil
+}
+
+// Constants of the ioprio_set system call.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// setIOPriority sets the I/O priority of the calling thread.
+func setIOPriority(class IOClass, level int) error {
+	prio := int(class)<<ioprioClassShift | level
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+	if errno != 0 {
+		return os.NewSyscallError("ioprio_set", errno)
+	}
+	return nil
+}
+
+// lockIOPriority locks the calling goroutine to its thread and sets the I/O priority of the thread, if
+// the options ask for one. The goroutine must not unlock the thread, so that the thread is ended rather
+// than reused with the priority when the goroutine returns. Builds ignore the error, and go on at the
+// usual priority.
+func lockIOPriority(o *ThrottleOpts) error {
+	if o == nil || o.IOClass == IOClassNone {
+		return nil
+	}
+	runtime.LockOSThread()
+	return setIOPriority(o.IOClass, o.IOLevel)
+}
+
+// limiter spaces events so that at most a given number happen per second.
+type limiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	// next is the earliest time of the next event.
+	next time.Time
+}
+
+// newLimiter returns a limiter for perSec events per second, or nil if perSec is not positive.
+func newLimiter(perSec float64) *limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / perSec)}
+}
+
+// wait returns once the next event may happen, or once done is closed.
+func (l *limiter) wait(done <-chan struct{}) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+
+	sleep(at.Sub(now), done)
+}
+
+// sleep pauses for d, or until done is closed.
+func sleep(d time.Duration, done <-chan struct{}) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-done:
+		t.Stop()
+	}
+}
+
+// The adaptive mode backs off while the recent latency of reading directories is more than
+// backoffFactor times the usual latency. The pause before reading each directory doubles from
+// minBackoff, up to maxBackoff, and halves once the latency is back to normal.
+const (
+	backoffFactor = 3
+	minBackoff    = time.Millisecond
+	maxBackoff    = time.Second
+)
+
+// throttle paces the reads of a build according to ThrottleOpts. It's shared by the build workers.
+type throttle struct {
+	dirs, stats *limiter
+	adaptive    bool
+	// done is closed when the build is cancelled, which ends the waits early.
+	done <-chan struct{}
+
+	// mutex protects the fields below.
+	mutex sync.Mutex
+	// usual and recent are moving averages of the latency of reading a batch of directory entries,
+	// over many reads and a few reads.
+	usual, recent time.Duration
+	// backoff is the pause before reading each directory in the adaptive mode.
+	backoff time.Duration
+}
+
+// newThrottle returns the throttle for the options o, or nil if o is nil.
+func newThrottle(o *ThrottleOpts, done <-chan struct{}) *throttle {
+	if o == nil {
+		return nil
+	}
+	return &throttle{
+		dirs:     newLimiter(o.DirsPerSec),
+		stats:    newLimiter(o.StatsPerSec),
+		adaptive: o.Adaptive,
+		done:     done,
+	}
+}
+
+// dir waits until the next directory may be read.
+func (t *throttle) dir() {
+	if t == nil {
+		return
+	}
+	t.dirs.wait(t.done)
+
+	t.mutex.Lock()
+	backoff := t.backoff
+	t.mutex.Unlock()
+	sleep(backoff, t.done)
+}
+
+// stat waits until the next entry may be looked up.
+func (t *throttle) stat() {
+	if t != nil {
+		t.stats.wait(t.done)
+	}
+}
+
+// readLatency records that reading a batch of directory entries took d, and adjusts the backoff.
+func (t *throttle) readLatency(d time.Duration) {
+	if t == nil || !t.adaptive {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.usual == 0 {
+		t.usual, t.recent = d, d
+		return
+	}
+	t.recent += (d - t.recent) / 4
+
+	if t.recent > backoffFactor*t.usual {
+		if t.backoff == 0 {
+			t.backoff = minBackoff
+		} else if t.backoff < maxBackoff {
+			t.backoff *= 2
+		}
+		return
+	}
+
+	// The usual latency is only learned while not backing off, so that it doesn't adapt to a busy disk.
+	if t.backoff == 0 {
+		t.usual += (d - t.usual) / 32
+	}
+	t.backoff /= 2
+	if t.backoff < minBackoff {
+		t.backoff = 0
+	}
+}
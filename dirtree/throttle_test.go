@@ -0,0 +1,132 @@
+package dirtree
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(100)
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		l.wait(nil)
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatal("21 events at 100 per second should take at least 200ms, but took", d)
+	}
+
+	// Waits end when done is closed.
+	l = newLimiter(0.1)
+	done := make(chan struct{})
+	close(done)
+	start = time.Now()
+	l.wait(done)
+	l.wait(done)
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("Waits should end when done is closed, but took", d)
+	}
+
+	if newLimiter(0) != nil {
+		t.Fatal("A limit of zero should not limit")
+	}
+}
+
+func TestThrottleAdaptive(t *testing.T) {
+	th := newThrottle(&ThrottleOpts{Adaptive: true}, nil)
+
+	for i := 0; i < 100; i++ {
+		th.readLatency(time.Millisecond)
+	}
+	if th.backoff != 0 {
+		t.Fatal("There should be no backoff at the usual latency, but it's", th.backoff)
+	}
+
+	// The disk gets busy.
+	for i := 0; i < 10; i++ {
+		th.readLatency(20 * time.Millisecond)
+	}
+	busy := th.backoff
+	if busy < minBackoff {
+		t.Fatal("The build should back off when reads are slow, but the backoff is", busy)
+	}
+	if busy > maxBackoff {
+		t.Fatal("The backoff should be at most", maxBackoff, "but it's", busy)
+	}
+
+	// And quiet again.
+	for i := 0; i < 50; i++ {
+		th.readLatency(time.Millisecond)
+	}
+	if th.backoff != 0 {
+		t.Fatal("The backoff should end once reads are fast again, but it's", th.backoff)
+	}
+}
+
+func TestBuildThrottle(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		opts := *DefaultBuildOpts
+		opts.Workers = workers
+		opts.Throttle = &ThrottleOpts{DirsPerSec: 20, StatsPerSec: 1000, Adaptive: true}
+
+		start := time.Now()
+		tree := buildIncrementalTree(makeTestFs(), &opts)
+
+		// The 4 directories are read 50ms apart.
+		if d := time.Since(start); d < 140*time.Millisecond {
+			t.Fatal("With", workers, "workers reading 4 directories at 20 per second should take at least 150ms, but took", d)
+		}
+		if tree.Root.Info.Size != 65 {
+			t.Fatal("With", workers, "workers the root should have size 65 but has", tree.Root.Info.Size)
+		}
+	}
+}
+
+func TestSetIOPriority(t *testing.T) {
+	errs := make(chan error)
+	go func() {
+		// The thread is ended when the goroutine returns, since it's not unlocked.
+		runtime.LockOSThread()
+		if err := setIOPriority(IOClassBestEffort, 7); err != nil {
+			errs <- err
+			return
+		}
+
+		prio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+		if errno != 0 {
+			errs <- errno
+			return
+		}
+		if prio != uintptr(IOClassBestEffort)<<ioprioClassShift|7 {
+			t.Error("The I/O priority should be best-effort level 7 but is", prio)
+		}
+		errs <- nil
+	}()
+
+	if err := <-errs; err != nil {
+		t.Skip("Setting the I/O priority is not permitted here:", err)
+	}
+}
+
+func TestNewThrottleOpts(t *testing.T) {
+	if o, err := NewThrottleOpts(0, 0, false, "none", 4); o != nil || err != nil {
+		t.Fatal("Options without limits should be nil, but are", o, err)
+	}
+	if o, err := NewThrottleOpts(10, 0, false, "none", 4); err != nil || o == nil || o.DirsPerSec != 10 {
+		t.Fatal("Options with a rate should limit it, but are", o, err)
+	}
+	for _, tc := range []struct {
+		class string
+		level int
+	}{{"fast", 4}, {"best-effort", 8}, {"idle", -1}} {
+		if _, err := NewThrottleOpts(0, 0, false, tc.class, tc.level); err == nil {
+			t.Fatal("The I/O class", tc.class, "with level", tc.level, "should be rejected")
+		}
+	}
+
+	o := &ThrottleOpts{IOClass: IOClassBestEffort, IOLevel: 7}
+	if err := o.Validate(); err != nil {
+		t.Skip("Setting the I/O priority is not permitted here:", err)
+	}
+}
@@ -0,0 +1,165 @@
+package dirtree
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileTypeMode selects how files are grouped into types when building, for the histogram in PathInfo.Types.
+type FileTypeMode uint8
+
+const (
+	// FileTypesNone doesn't group files by type.
+	FileTypesNone FileTypeMode = iota
+	// FileTypesExtension groups files by their lower case extension, such as ".log".
+	FileTypesExtension
+	// FileTypesClass groups files by the top-level MIME type of their extension, such as "image".
+	FileTypesClass
+)
+
+var fileTypeModeNames = []string{"none", "ext", "class"}
+
+func (m FileTypeMode) String() string {
+	if int(m) < len(fileTypeModeNames) {
+		return fileTypeModeNames[m]
+	}
+	return fmt.Sprintf("FileTypeMode(%d)", m)
+}
+
+// ParseFileTypeMode returns the FileTypeMode with the name s, as returned by FileTypeMode.String.
+func ParseFileTypeMode(s string) (FileTypeMode, error) {
+	for i, v := range fileTypeModeNames {
+		if v == s {
+			return FileTypeMode(i), nil
+		}
+	}
+	return FileTypesNone, fmt.Errorf("Unknown file type mode '%s'. Must be one of none, ext or class", s)
+}
+
+const (
+	// NoExtension is the type of files without an extension in FileTypesExtension.
+	NoExtension = "(none)"
+	// UnknownClass is the type of files whose extension has no known MIME type in FileTypesClass.
+	UnknownClass = "(unknown)"
+)
+
+// FileType returns the type of the file path in the FileTypeMode m, or "" for FileTypesNone.
+func FileType(path string, m FileTypeMode) string {
+	if m == FileTypesNone {
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if m == FileTypesExtension {
+		if ext == "" || ext == "." {
+			return NoExtension
+		}
+		return ext
+	}
+
+	class := mime.TypeByExtension(ext)
+	if i := strings.IndexByte(class, '/'); i > 0 {
+		return class[:i]
+	}
+	return UnknownClass
+}
+
+// TypeTotals are the sizes and number of the files of one type or owner.
+type TypeTotals struct {
+	Size, AllocSize, Files int64
+}
+
+// SizeIn returns the size of the files measured using the SizeMode m. The number of files is used for
+// SizeModeEntries, and the apparent size for SizeModeStaleness.
+func (t *TypeTotals) SizeIn(m SizeMode) int64 {
+	switch m {
+	case SizeModeAllocated:
+		return t.AllocSize
+	case SizeModeEntries:
+		return t.Files
+	}
+	return t.Size
+}
+
+// TypeHistogram holds the totals of the files of each type at or under a path. Types without files are left out.
+type TypeHistogram map[string]TypeTotals
+
+// add adds the totals t to the type typ, and returns the histogram, which is allocated if h is nil. Nothing is
+// added if typ is empty.
+func (h TypeHistogram) add(typ string, t TypeTotals) TypeHistogram {
+	if typ == "" {
+		return h
+	}
+	if h == nil {
+		h = make(TypeHistogram)
+	}
+
+	v := h[typ]
+	v.Size += t.Size
+	v.AllocSize += t.AllocSize
+	v.Files += t.Files
+	if v == (TypeTotals{}) {
+		delete(h, typ)
+	} else {
+		h[typ] = v
+	}
+	return h
+}
+
+// merge adds the totals in o to h, and returns the histogram. It's nil if no types are left, and
+// is never o itself.
+func (h TypeHistogram) merge(o TypeHistogram) TypeHistogram {
+	for typ, t := range o {
+		h = h.add(typ, t)
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// neg returns a histogram holding the negation of the totals in h.
+func (h TypeHistogram) neg() TypeHistogram {
+	var n TypeHistogram
+	for typ, t := range h {
+		n = n.add(typ, TypeTotals{-t.Size, -t.AllocSize, -t.Files})
+	}
+	return n
+}
+
+// clone returns a copy of h.
+func (h TypeHistogram) clone() TypeHistogram {
+	return TypeHistogram(nil).merge(h)
+}
+
+// TypeCount is a file type and the totals of the files of the type.
+type TypeCount struct {
+	Type string
+	TypeTotals
+}
+
+// TopTypes returns the types of the files under the node, from largest to smallest in the SizeMode m.
+// At most count types are returned, unless count is not positive. Nothing is returned for the nodes of
+// files, or if the tree was built with FileTypesNone.
+func (n *Node) TopTypes(count int, m SizeMode) []TypeCount {
+	types := make([]TypeCount, 0, len(n.Info.Types))
+	for typ, t := range n.Info.Types {
+		types = append(types, TypeCount{typ, t})
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		si, sj := types[i].SizeIn(m), types[j].SizeIn(m)
+		if si != sj {
+			return si > sj
+		}
+		return types[i].Type < types[j].Type
+	})
+
+	if count > 0 && len(types) > count {
+		types = types[:count]
+	}
+	return types
+}
@@ -0,0 +1,104 @@
+package dirtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileType(t *testing.T) {
+	tests := []struct {
+		path string
+		mode FileTypeMode
+		typ  string
+	}{
+		{"/tmp/a.log", FileTypesNone, ""},
+		{"/tmp/a.log", FileTypesExtension, ".log"},
+		{"/tmp/A.JAR", FileTypesExtension, ".jar"},
+		{"/tmp/blort", FileTypesExtension, NoExtension},
+		{"/tmp/blort.", FileTypesExtension, NoExtension},
+		{"/tmp/a.png", FileTypesClass, "image"},
+		{"/tmp/a.PNG", FileTypesClass, "image"},
+		{"/tmp/a.nosuchext", FileTypesClass, UnknownClass},
+		{"/tmp/blort", FileTypesClass, UnknownClass},
+	}
+
+	for _, tc := range tests {
+		if typ := FileType(tc.path, tc.mode); typ != tc.typ {
+			t.Fatal("In mode", tc.mode, tc.path, "should have type", tc.typ, "but has", typ)
+		}
+	}
+}
+
+func TestBuildTypes(t *testing.T) {
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+		opts.FileTypes = FileTypesExtension
+		tree := buildIncrementalTree(makeTestFs(), &opts)
+
+		expected := []TypeCount{{".txt", TypeTotals{Size: 35, Files: 3}}, {NoExtension, TypeTotals{Size: 30, Files: 1}}}
+		if types := tree.Root.TopTypes(0, SizeModeApparent); !reflect.DeepEqual(types, expected) {
+			t.Fatal("With files", includeFiles, "root should have types", expected, "but has", types)
+		}
+		if types := tree.Root.TopTypes(1, SizeModeEntries); len(types) != 1 || types[0].Type != ".txt" {
+			t.Fatal("With files", includeFiles, "the top type by entries should be .txt but got", types)
+		}
+
+		a := childWithBasename(tree.Root, "a")
+		expected = []TypeCount{{".txt", TypeTotals{Size: 30, Files: 2}}}
+		if types := a.TopTypes(0, SizeModeApparent); !reflect.DeepEqual(types, expected) {
+			t.Fatal("With files", includeFiles, "a should have types", expected, "but has", types)
+		}
+		if f := childWithBasename(a, "file1.txt"); includeFiles && (f == nil || f.Info.Types != nil) {
+			t.Fatal("The types should only be kept on directories, but file1.txt is", f)
+		}
+
+		// The types are kept up to date when a directory is read again.
+		fs := makeTestFs()
+		fs.Files["/tmp/a"] = TestFile{NewTestFileInfo("file1.txt", false, 1000), NewTestFileInfo("new.log", false, 7)}
+		tree.ApplyUpdate(ReadDirUpdate(fs, "/tmp", "/tmp/a", &opts))
+
+		expectedTree := buildIncrementalTree(fs, &opts)
+		if !reflect.DeepEqual(tree.Root.Info.Types, expectedTree.Root.Info.Types) {
+			t.Fatal("With files", includeFiles, "the updated root should have types", expectedTree.Root.Info.Types, "but has", tree.Root.Info.Types)
+		}
+	}
+}
+
+func TestBuildTypesHardLinks(t *testing.T) {
+	link := func(name string) TestFileInfo {
+		fi := NewTestFileInfo(name, false, 100)
+		fi.ino = 5
+		fi.nlink = 2
+		return fi
+	}
+
+	fs := TestFs{
+		Files: map[string]TestFile{
+			"/tmp":   TestFile{NewTestFileInfo("a", true, 0), NewTestFileInfo("b", true, 0)},
+			"/tmp/a": TestFile{link("x.bin"), NewTestFileInfo("z.txt", false, 10)},
+			"/tmp/b": TestFile{link("y.bin")},
+		},
+	}
+
+	for _, mode := range []HardLinkMode{HardLinksCountAll, HardLinksFirstPath, HardLinksShared} {
+		for _, includeFiles := range []bool{false, true} {
+			opts := *DefaultBuildOpts
+			opts.HardLinks = mode
+			opts.IncludeFiles = includeFiles
+			opts.FileTypes = FileTypesExtension
+			tree := buildIncrementalTree(fs, &opts)
+
+			// Every byte and file is counted under exactly one type.
+			var total TypeTotals
+			for _, t := range tree.Root.Info.Types {
+				total.Size += t.Size
+				total.Files += t.Files
+			}
+			if total.Size != tree.Root.Info.Size || total.Files != tree.Root.Info.Files {
+				t.Fatal("In mode", mode, "with files", includeFiles, "the types hold", total, "but the root has size",
+					tree.Root.Info.Size, "and", tree.Root.Info.Files, "files")
+			}
+		}
+	}
+}
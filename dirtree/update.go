@@ -0,0 +1,128 @@
+package dirtree
+
+// DirUpdate holds the entries of a single directory, read again after the tree that holds it was
+// built, so that the tree can be brought up to date with Dirtree.ApplyUpdate.
+type DirUpdate struct {
+	// Path of the directory.
+	Path string
+	// Vanished is true if the directory no longer exists.
+	Vanished bool
+	l        *dirListing
+}
+
+// ReadDirUpdate reads the directory path, which is in a tree built from root with the options opts,
+// for Dirtree.ApplyUpdate. Only the directory itself is read, not its subdirectories. Files with more
+// than one hard link are counted in full, whatever opts.HardLinks is.
+func ReadDirUpdate(fs Filesystem, root, path string, opts *BuildOpts) *DirUpdate {
+	o := *opts
+	o.IncludeFiles = true
+	o.Previous = nil
+
+	baseDevId, _ := fs.DeviceId(root)
+	r := newDirReader(fs, &o, root, baseDevId)
+
+	l := newDirListing(path)
+	if sfs, ok := fs.(StatFilesystem); ok {
+		if fi, err := sfs.Stat(path); err == nil {
+			l.stamp = newDirStamp(fi)
+		}
+	}
+	r.readDir(l)
+
+	for _, link := range l.links {
+		l.entries[link.entry].SharedSize = link.size
+		l.types = l.types.add(link.typ, TypeTotals{link.size, link.allocSize, 1})
+		link.owner.addTo(&l.users, &l.groups, TypeTotals{link.size, link.allocSize, 1})
+	}
+
+	u := &DirUpdate{Path: path, l: l}
+	u.Vanished = !l.accurate && len(l.entries) == 0 && len(l.errors) == 1 && l.errors[0].Path == path && l.errors[0].Kind == ErrorVanished
+	return u
+}
+
+// ApplyUpdate brings the node for the directory read in u up to date, along with the sizes of its
+// ancestors, and returns the nodes it added. Subdirectories that are new are added as empty nodes,
+// which must be filled in by building the subdirectory and applying the operations with an
+// ApplyContext for the node. The nodes that are removed are left without a parent. Files are added as
+// nodes only if the directory already has nodes for files; otherwise they are counted in the directory
+// itself. As with other changes, the times and layer are not narrowed, and a node that was inaccurate stays so.
+//
+// Nothing is done if the directory is not in the tree or has vanished, since it's removed by the
+// update of its parent.
+func (t *Dirtree) ApplyUpdate(u *DirUpdate) (added []*Node) {
+	n := t.Find(u.Path)
+	if n == nil || n.Info.Type == PathTypeShared || !n.Info.Type.isDirLike() || u.Vanished {
+		return nil
+	}
+	l := u.l
+
+	files := false
+	old := make(map[string]*Node, len(n.Children))
+	for _, c := range n.Children {
+		if !c.Info.Type.isDirLike() && c.Info.Type != PathTypeMount {
+			files = true
+		}
+		old[c.Info.Basename] = c
+	}
+
+	// delta is the change to the totals of n: the new totals less the current ones.
+	delta := n.Info.negTotals()
+	delta.addTotals(&PathInfo{Size: l.size, AllocSize: l.allocSize, SharedSize: l.sharedSize, Files: l.files, Dirs: l.dirs, Other: l.other,
+		Types: l.types, Users: l.users, Groups: l.groups, Times: l.times})
+
+	children := make([]*Node, 0, len(n.Children))
+	keep := func(c *Node) {
+		children = append(children, c)
+		delta.addTotals(&c.Info)
+	}
+	addNode := func(op *OpData) {
+		c := &Node{Parent: n, SortChildren: n.SortChildren, SizeMode: n.SizeMode,
+			Info: PathInfo{Path: op.Path, Basename: op.Basename, SizeAccurate: true, Type: op.Type, FsType: op.FsType}}
+		if !op.Type.isDirLike() {
+			c.Info.addTotals(op.sizes())
+		}
+		c.Info.Times = op.Times
+		added = append(added, c)
+		keep(c)
+	}
+
+	for i := range l.entries {
+		op := &l.entries[i]
+		c := old[op.Basename]
+		delete(old, op.Basename)
+
+		if op.Type.isDirLike() {
+			// The subdirectory is counted by its parent.
+			delta.Dirs++
+			if c != nil && c.Info.Type == op.Type {
+				keep(c)
+				continue
+			}
+		}
+
+		if c != nil {
+			c.Parent = nil
+		}
+		if op.Type.isDirLike() || op.Type == PathTypeMount || files {
+			addNode(op)
+		} else {
+			delta.addTotals(op.sizes())
+		}
+	}
+
+	// The node for shared hard links is not an entry of the directory.
+	for _, c := range old {
+		if c.Info.Type == PathTypeShared {
+			keep(c)
+		} else {
+			c.Parent = nil
+		}
+	}
+
+	n.Children = children
+	n.Info.Errors = l.errors
+	n.Info.Sparse = l.sparse
+	n.Info.ModTime, n.Info.ChangeTime = l.stamp.modTime, l.stamp.changeTime
+	n.addSize(delta, l.accurate)
+	return
+}
@@ -0,0 +1,73 @@
+package dirtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+// treeTotals returns the totals of each node of the tree t, by path.
+func treeTotals(t *Dirtree) map[string][4]int64 {
+	totals := make(map[string][4]int64)
+	t.Root.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		totals[n.Info.Path] = [4]int64{n.Info.Size, n.Info.Files, n.Info.Dirs, n.Info.Other}
+		return true, false
+	}, 0)
+	return totals
+}
+
+func TestApplyUpdate(t *testing.T) {
+	for _, includeFiles := range []bool{false, true} {
+		opts := *DefaultBuildOpts
+		opts.IncludeFiles = includeFiles
+		tree := buildIncrementalTree(makeTestFs(), &opts)
+
+		// A file grows, a directory is removed and another is added.
+		fs := makeTestFs()
+		fs.Files["/tmp/a"][0] = NewTestFileInfo("file1.txt", false, 1000)
+		fs.Files["/tmp/b"] = TestFile{NewTestFileInfo("a.txt", false, 5), NewTestFileInfo("new", true, 0)}
+		delete(fs.Files, "/tmp/b/dir")
+		fs.Files["/tmp/b/new"] = TestFile{NewTestFileInfo("x", false, 7), NewTestFileInfo("y", false, 8)}
+
+		var added []*Node
+		for _, path := range []string{"/tmp/a", "/tmp/b", "/tmp/b/dir"} {
+			added = append(added, tree.ApplyUpdate(ReadDirUpdate(fs, "/tmp", path, &opts))...)
+		}
+
+		for _, n := range added {
+			if !n.Info.Type.isDirLike() {
+				continue
+			}
+			if n.Info.Path != "/tmp/b/new" {
+				t.Fatal("With files", includeFiles, "only /tmp/b/new should be added as a directory, but", n.Info.Path, "was")
+			}
+			ops := make(chan OpData)
+			go build(fs, n.Info.Path, ops, nil, &opts)
+			ctx := NewApplyContext(n)
+			for op := range ops {
+				tree.ApplyCtx(ctx, op)
+			}
+		}
+
+		expected := treeTotals(buildIncrementalTree(fs, &opts))
+		if got := treeTotals(tree); !reflect.DeepEqual(got, expected) {
+			t.Fatal("With files", includeFiles, "the updated tree has totals", got, "but should have", expected)
+		}
+	}
+}
+
+func TestApplyUpdateVanished(t *testing.T) {
+	opts := *DefaultBuildOpts
+	tree := buildIncrementalTree(makeTestFs(), &opts)
+	expected := treeTotals(tree)
+
+	fs := makeTestFs()
+	delete(fs.Files, "/tmp/b/dir")
+
+	u := ReadDirUpdate(fs, "/tmp", "/tmp/b/dir", &opts)
+	if !u.Vanished {
+		t.Fatal("The update of a removed directory should be marked as vanished")
+	}
+	if added := tree.ApplyUpdate(u); added != nil || !reflect.DeepEqual(treeTotals(tree), expected) {
+		t.Fatal("Applying the update of a removed directory should do nothing")
+	}
+}
@@ -0,0 +1,412 @@
+package dirtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	sh "github.com/jeffwilliams/spacehoarder"
+)
+
+// WatchMode describes how closely a Watcher follows the changes to the directories of a tree.
+type WatchMode uint8
+
+const (
+	// WatchInotify means that every directory is watched with inotify.
+	WatchInotify WatchMode = iota
+	// WatchFanotify means the inotify watch limit was reached. Files modified in the directories that could not
+	// be watched are reported by fanotify, and the directories are also read again every RescanInterval to find
+	// the entries that were added or removed.
+	WatchFanotify
+	// WatchRescan means the inotify watch limit was reached and fanotify is not permitted, so the directories
+	// that could not be watched are only read again every RescanInterval.
+	WatchRescan
+)
+
+var watchModeNames = []string{"inotify", "fanotify", "rescan"}
+
+func (m WatchMode) String() string {
+	if int(m) < len(watchModeNames) {
+		return watchModeNames[m]
+	}
+	return fmt.Sprintf("WatchMode(%d)", m)
+}
+
+type WatchOpts struct {
+	// Delay is how long changes are collected before the directories that changed are read.
+	Delay time.Duration
+	// RescanInterval is how often the directories that could not be watched are read again.
+	RescanInterval time.Duration
+}
+
+var DefaultWatchOpts = &WatchOpts{
+	Delay:          500 * time.Millisecond,
+	RescanInterval: 5 * time.Minute,
+}
+
+// The inotify events that change the entries of a directory or their sizes.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// Constants of the fanotify API, which the syscall package doesn't define.
+const (
+	fanCloexec    = 0x1
+	fanNonblock   = 0x2
+	fanMarkAdd    = 0x1
+	fanMarkMount  = 0x10
+	fanModify     = 0x2
+	fanCloseWrite = 0x8
+	atFdcwd       = -0x64
+)
+
+// fanotifyEvent is struct fanotify_event_metadata.
+type fanotifyEvent struct {
+	EventLen    uint32
+	Vers        uint8
+	Reserved    uint8
+	MetadataLen uint16
+	Mask        uint64
+	Fd          int32
+	Pid         int32
+}
+
+// Watcher watches the directories of a tree built from the local filesystem, and reads them again when
+// they change. The updates are written to Updates, to be applied to the tree with Dirtree.ApplyUpdate.
+type Watcher struct {
+	// Updates receives an update for each directory that changed. It's closed when the Watcher is closed.
+	Updates chan *DirUpdate
+
+	root      string
+	absRoot   string
+	buildOpts *BuildOpts
+	opts      *WatchOpts
+	fd        int
+	inotify   *os.File
+	changed   chan string
+	done      chan struct{}
+
+	// mutex protects the fields below.
+	mutex sync.Mutex
+	// wds maps each inotify watch to the path of its directory.
+	wds map[int32]string
+	// unwatched holds the directories that could not be watched because the watch limit was reached.
+	unwatched map[string]bool
+	// fanotify is nil until the watch limit is reached, or if fanotify is not permitted.
+	fanotify   *os.File
+	fanotifyFd int
+	fanotifyOk bool
+	// marked holds the devices of the mounts marked with fanotify.
+	marked map[uint64]bool
+	// limit is the number of watches at which the watch limit is treated as reached, if it's not zero.
+	limit int
+}
+
+// NewWatcher returns a Watcher for a tree built from root with the options buildOpts. The directories
+// to watch are added with AddTree.
+func NewWatcher(root string, buildOpts *BuildOpts, opts *WatchOpts) (*Watcher, error) {
+	if opts == nil {
+		opts = DefaultWatchOpts
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &Watcher{
+		Updates:    make(chan *DirUpdate),
+		root:       root,
+		absRoot:    absRoot,
+		buildOpts:  buildOpts,
+		opts:       opts,
+		fd:         fd,
+		inotify:    os.NewFile(uintptr(fd), "inotify"),
+		changed:    make(chan string),
+		done:       make(chan struct{}),
+		wds:        make(map[int32]string),
+		unwatched:  make(map[string]bool),
+		fanotifyOk: true,
+		marked:     make(map[uint64]bool),
+	}
+
+	go w.readInotify()
+	go w.run()
+	return w, nil
+}
+
+// AddTree watches the directories of the node n and its descendants. It must be called again for the
+// nodes added when updates are applied, once they are built. The tree must not be modified during the call.
+func (w *Watcher) AddTree(n *Node) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n.Walk(func(n *Node, depth int) (cont, skipChildren bool) {
+		if n.Info.Type == PathTypeDir || n.Info.Type == PathTypeSymlinkDir {
+			w.add(n.Info.Path)
+		}
+		return true, false
+	}, 0)
+}
+
+// add watches the directory path, or, if the watch limit is reached, reads it again periodically.
+func (w *Watcher) add(path string) {
+	if w.limit == 0 || len(w.wds) < w.limit {
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err == nil {
+			w.wds[int32(wd)] = path
+			delete(w.unwatched, path)
+			return
+		}
+		if err != syscall.ENOSPC {
+			// The directory can't be read either, or it's gone.
+			return
+		}
+	}
+
+	w.unwatched[path] = true
+	w.markMount(path)
+}
+
+// markMount reports the files modified on the mount that holds path with fanotify, if it's permitted.
+func (w *Watcher) markMount(path string) {
+	if !w.fanotifyOk {
+		return
+	}
+
+	if w.fanotify == nil {
+		fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, fanCloexec|fanNonblock, syscall.O_RDONLY|syscall.O_LARGEFILE|syscall.O_CLOEXEC, 0)
+		if errno != 0 {
+			w.fanotifyOk = false
+			return
+		}
+		w.fanotifyFd = int(fd)
+		w.fanotify = os.NewFile(fd, "fanotify")
+		go w.readFanotify(w.fanotify)
+	}
+
+	dev, err := sh.GetFsDevId(path)
+	if err != nil || w.marked[dev] {
+		return
+	}
+
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(w.fanotifyFd), fanMarkAdd|fanMarkMount,
+		fanModify|fanCloseWrite, uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0)
+	if errno == 0 {
+		w.marked[dev] = true
+	}
+}
+
+// Mode returns how closely the changes to the directories are followed.
+func (w *Watcher) Mode() WatchMode {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch {
+	case len(w.unwatched) == 0:
+		return WatchInotify
+	case len(w.marked) > 0:
+		return WatchFanotify
+	}
+	return WatchRescan
+}
+
+// Close stops watching, and closes Updates.
+func (w *Watcher) Close() error {
+	close(w.done)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.fanotify != nil {
+		w.fanotify.Close()
+	}
+	return w.inotify.Close()
+}
+
+// forget stops watching path and the directories under it, which were moved or removed.
+func (w *Watcher) forget(path string) {
+	prefix := path + string(os.PathSeparator)
+	for wd, p := range w.wds {
+		if p == path || strings.HasPrefix(p, prefix) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, wd)
+		}
+	}
+	for p := range w.unwatched {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(w.unwatched, p)
+		}
+	}
+}
+
+// notify writes the directories that changed to w.changed. It returns false if the watcher was closed.
+func (w *Watcher) notify(paths ...string) bool {
+	for _, p := range paths {
+		select {
+		case w.changed <- p:
+		case <-w.done:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Watcher) readInotify() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			var paths []string
+			w.mutex.Lock()
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were lost, so every directory may have changed.
+				for _, p := range w.wds {
+					paths = append(paths, p)
+				}
+				for p := range w.unwatched {
+					paths = append(paths, p)
+				}
+			} else if path, ok := w.wds[ev.Wd]; ok {
+				switch {
+				case ev.Mask&syscall.IN_IGNORED != 0:
+					delete(w.wds, ev.Wd)
+				case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+					// The parent is notified as well. If the directory was moved within the tree,
+					// it's watched again at its new path once it's built there.
+					w.forget(path)
+				default:
+					paths = append(paths, path)
+				}
+			}
+			w.mutex.Unlock()
+
+			if !w.notify(paths...) {
+				return
+			}
+		}
+	}
+}
+
+func (w *Watcher) readFanotify(f *os.File) {
+	buf := make([]byte, 4096)
+	size := int(unsafe.Sizeof(fanotifyEvent{}))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+size <= n; {
+			ev := (*fanotifyEvent)(unsafe.Pointer(&buf[off]))
+			if int(ev.EventLen) < size {
+				break
+			}
+			off += int(ev.EventLen)
+			if ev.Fd < 0 {
+				continue
+			}
+
+			target, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", ev.Fd))
+			syscall.Close(int(ev.Fd))
+			if err != nil || !strings.HasPrefix(target, w.absRoot) {
+				continue
+			}
+			dir := filepath.Dir(w.root + target[len(w.absRoot):])
+
+			// Changes in the watched directories are reported by inotify.
+			w.mutex.Lock()
+			unwatched := w.unwatched[dir]
+			w.mutex.Unlock()
+
+			if unwatched && !w.notify(dir) {
+				return
+			}
+		}
+	}
+}
+
+// run collects the directories that changed, and reads them once changes stop for opts.Delay.
+func (w *Watcher) run() {
+	defer close(w.Updates)
+
+	rescan := time.NewTicker(w.opts.RescanInterval)
+	defer rescan.Stop()
+
+	dirty := make(map[string]bool)
+	var delay <-chan time.Time
+
+	for {
+		select {
+		case p := <-w.changed:
+			dirty[p] = true
+		case <-rescan.C:
+			w.mutex.Lock()
+			for p := range w.unwatched {
+				dirty[p] = true
+			}
+			w.mutex.Unlock()
+		case <-delay:
+			delay = nil
+			if !w.update(dirty) {
+				return
+			}
+			dirty = make(map[string]bool)
+		case <-w.done:
+			return
+		}
+
+		if delay == nil && len(dirty) > 0 {
+			delay = time.After(w.opts.Delay)
+		}
+	}
+}
+
+// update reads the directories in dirty and writes the updates. It returns false if the watcher was closed.
+func (w *Watcher) update(dirty map[string]bool) bool {
+	paths := make([]string, 0, len(dirty))
+	for p := range dirty {
+		paths = append(paths, p)
+	}
+	// Parents come before the directories they contain.
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		u := ReadDirUpdate(OsFilesystem{}, w.root, p, w.buildOpts)
+		if u.Vanished {
+			w.mutex.Lock()
+			w.forget(p)
+			w.mutex.Unlock()
+			continue
+		}
+
+		select {
+		case w.Updates <- u:
+		case <-w.done:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package dirtree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// applyUpdates applies the updates from w to the tree until done returns true, building the directories that are added.
+func applyUpdates(t *testing.T, w *Watcher, tree *Dirtree, opts *BuildOpts, done func() bool) {
+	timeout := time.After(10 * time.Second)
+	for !done() {
+		select {
+		case u := <-w.Updates:
+			for _, n := range tree.ApplyUpdate(u) {
+				if !n.Info.Type.isDirLike() {
+					continue
+				}
+				ops := make(chan OpData)
+				go build(OsFilesystem{}, n.Info.Path, ops, nil, opts)
+				ctx := NewApplyContext(n)
+				for op := range ops {
+					tree.ApplyCtx(ctx, op)
+				}
+				w.AddTree(n)
+			}
+		case <-timeout:
+			t.Fatal("The tree was not updated. Its totals are", treeTotals(tree))
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, size int) {
+	if err := os.WriteFile(name, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a", "b", "f"), 10)
+
+	opts := *DefaultBuildOpts
+	tree := BuildSync(dir, &opts)
+
+	w, err := NewWatcher(dir, &opts, &WatchOpts{Delay: 10 * time.Millisecond, RescanInterval: time.Hour})
+	if err != nil {
+		t.Skip("inotify is not available:", err)
+	}
+	defer w.Close()
+	w.AddTree(tree.Root)
+
+	if w.Mode() != WatchInotify {
+		t.Fatal("All directories should be watched with inotify, but the mode is", w.Mode())
+	}
+
+	writeFile(t, filepath.Join(dir, "a", "b", "f"), 100)
+	if err := os.Mkdir(filepath.Join(dir, "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "c", "g"), 5)
+
+	applyUpdates(t, w, tree, &opts, func() bool {
+		c := tree.Find(filepath.Join(dir, "c"))
+		return tree.Root.Info.Size == 105 && c != nil && c.Info.Size == 5 && tree.Root.Info.Dirs == 3
+	})
+
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	applyUpdates(t, w, tree, &opts, func() bool {
+		return tree.Root.Info.Size == 5 && tree.Root.Info.Dirs == 1 && len(tree.Root.Children) == 1
+	})
+}
+
+func TestWatchLimit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := *DefaultBuildOpts
+	tree := BuildSync(dir, &opts)
+
+	w, err := NewWatcher(dir, &opts, &WatchOpts{Delay: 10 * time.Millisecond, RescanInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Skip("inotify is not available:", err)
+	}
+	defer w.Close()
+
+	// Only the root can be watched, so a is read again periodically.
+	w.limit = 1
+	w.AddTree(tree.Root)
+
+	if w.Mode() == WatchInotify {
+		t.Fatal("Some directories should not be watched with inotify")
+	}
+
+	writeFile(t, filepath.Join(dir, "a", "f"), 42)
+	applyUpdates(t, w, tree, &opts, func() bool {
+		return tree.Root.Info.Size == 42
+	})
+}
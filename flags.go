@@ -0,0 +1,15 @@
+package spacehoarder
+
+import "strings"
+
+// StringList is a flag.Value that collects the values of a flag that may be repeated.
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
@@ -1,9 +1,11 @@
 package spacehoarder
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 )
 
 func GetFsDevId(path string) (uint64, error) {
@@ -19,3 +21,92 @@ func GetFsDevId(path string) (uint64, error) {
 
 	return stat.Dev, nil
 }
+
+// GetAllocatedSize returns the number of bytes allocated on disk for the file described by fi;
+// that is, the number of 512-byte blocks reported by stat multiplied by 512.
+func GetAllocatedSize(fi os.FileInfo) (int64, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		return 0, fmt.Errorf("Unable to determine allocated size because underlying implementation does not support it")
+	}
+
+	return int64(stat.Blocks) * 512, nil
+}
+
+// GetLinkInfo returns the device and inode numbers of the file described by fi, and the
+// number of hard links to it.
+func GetLinkInfo(fi os.FileInfo) (dev, ino, nlink uint64, err error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		err = fmt.Errorf("Unable to determine inode because underlying implementation does not support it")
+		return
+	}
+
+	return stat.Dev, stat.Ino, uint64(stat.Nlink), nil
+}
+
+// GetChangeTime returns the last status change time of the file described by fi.
+func GetChangeTime(fi os.FileInfo) (time.Time, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		return time.Time{}, fmt.Errorf("Unable to determine change time because underlying implementation does not support it")
+	}
+
+	return time.Unix(stat.Ctim.Unix()), nil
+}
+
+// GetAccessTime returns the last access time of the file described by fi.
+func GetAccessTime(fi os.FileInfo) (time.Time, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		return time.Time{}, fmt.Errorf("Unable to determine access time because underlying implementation does not support it")
+	}
+
+	return time.Unix(stat.Atim.Unix()), nil
+}
+
+// GetOwner returns the user and group ids of the owner of the file described by fi.
+func GetOwner(fi os.FileInfo) (uid, gid uint32, err error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		err = fmt.Errorf("Unable to determine owner because underlying implementation does not support it")
+		return
+	}
+
+	return stat.Uid, stat.Gid, nil
+}
+
+// The whence values of lseek that find the data and holes of a file, which the syscall package doesn't define.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// GetDataSize returns the number of bytes of the file path that are in data extents rather than holes,
+// found with SEEK_DATA and SEEK_HOLE. Filesystems that don't support them report the whole file as data.
+func GetDataSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size, off int64
+	for {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// No data after off.
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return 0, err
+		}
+		size += end - start
+		off = end
+	}
+}
@@ -0,0 +1,55 @@
+package spacehoarder
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetDataSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "sphsparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// One block of data followed by a large hole.
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := GetAllocatedSize(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filesystems that don't keep holes report the whole file as data.
+	holes := alloc < 64<<20
+
+	size, err := GetDataSize(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holes && (size < 4096 || size > 1<<20) {
+		t.Fatal("Data size should be about 4096, far below the file size, but is", size)
+	}
+
+	// An empty file has no data.
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := GetDataSize(f.Name()); err != nil || size != 0 {
+		t.Fatal("An empty file should have no data but has", size, err)
+	}
+
+	if !holes {
+		t.Skip("The filesystem of", f.Name(), "doesn't keep holes, so the data size of a sparse file can't be checked")
+	}
+}
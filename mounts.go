@@ -0,0 +1,141 @@
+package spacehoarder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountInfoFile lists the filesystems mounted in the mount namespace of the process.
+const MountInfoFile = "/proc/self/mountinfo"
+
+// Mount is a mounted filesystem.
+type Mount struct {
+	// Point is the absolute path where the filesystem is mounted.
+	Point string
+	// FsType is the type of the filesystem, such as "ext4" or "nfs".
+	FsType string
+	// Source is where the filesystem comes from, such as "/dev/sda1" or "server:/export".
+	Source string
+	// Options are the options of the mount, such as "rw" and "noatime", followed by those of the filesystem.
+	Options []string
+	// Dev is the device id of the files in the filesystem, as returned by GetFsDevId.
+	Dev uint64
+}
+
+// MountTable is a list of mounts, in the order they were mounted.
+type MountTable []Mount
+
+// ReadMountTable reads a file in the format of /proc/self/mountinfo.
+func ReadMountTable(path string) (MountTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseMountTable(f)
+}
+
+// ParseMountTable parses the mounts in the format of /proc/self/mountinfo from r. Lines that are
+// malformed are skipped.
+func ParseMountTable(r io.Reader) (MountTable, error) {
+	var t MountTable
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if m, err := parseMount(s.Text()); err == nil {
+			t = append(t, m)
+		}
+	}
+	return t, s.Err()
+}
+
+// parseMount parses a line of /proc/self/mountinfo, which looks like:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// The fields are the mount id, parent id, major:minor, root within the filesystem, mount point and
+// mount options, then optional fields ended by "-", then the filesystem type, source and filesystem options.
+func parseMount(line string) (m Mount, err error) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fields) < sep+3 {
+		return m, fmt.Errorf("malformed mount '%s'", line)
+	}
+
+	var major, minor uint64
+	if _, err = fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+		return m, fmt.Errorf("malformed device in mount '%s'", line)
+	}
+
+	m.Point = unescapeMountField(fields[4])
+	m.FsType = unescapeMountField(fields[sep+1])
+	m.Source = unescapeMountField(fields[sep+2])
+	m.Options = strings.Split(fields[5], ",")
+	if len(fields) > sep+3 {
+		m.Options = append(m.Options, strings.Split(fields[sep+3], ",")...)
+	}
+	m.Dev = mkdev(major, minor)
+	return m, nil
+}
+
+// unescapeMountField replaces the octal escapes, such as \040 for a space, that the kernel writes for
+// characters in the fields of mountinfo.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mkdev returns the device id of the device with the major and minor numbers, encoded the way Linux does.
+func mkdev(major, minor uint64) uint64 {
+	return (major&0xfffff000)<<32 | (major&0xfff)<<8 | (minor&0xffffff00)<<12 | minor&0xff
+}
+
+// At returns the mount at the mount point path, or nil if there is none. If several filesystems are mounted
+// at the path, the last one is returned, since it hides the others.
+func (t MountTable) At(path string) *Mount {
+	for i := len(t) - 1; i >= 0; i-- {
+		if t[i].Point == path {
+			return &t[i]
+		}
+	}
+	return nil
+}
+
+// Find returns the mount that holds the absolute path, which is the last mount at the longest mount
+// point that is path or one of its ancestors. It returns nil if there is none.
+func (t MountTable) Find(path string) *Mount {
+	path = filepath.Clean(path)
+	for p := path; ; p = filepath.Dir(p) {
+		if m := t.At(p); m != nil {
+			return m
+		}
+		if p == filepath.Dir(p) {
+			return nil
+		}
+	}
+}
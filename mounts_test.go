@@ -0,0 +1,68 @@
+package spacehoarder
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountTable(t *testing.T) {
+	data := "23 28 0:22 / /proc rw,relatime - proc proc rw\n" +
+		"28 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro\n" +
+		"malformed line\n" +
+		"40 28 0:45 / /mnt/my\\040share rw,nosuid master:3 shared:4 - nfs4 server:/export rw,vers=4.2\n" +
+		"41 40 8:17 / /mnt/my\\040share ro - xfs /dev/sdb1 rw\n"
+
+	table, err := ParseMountTable(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 4 {
+		t.Fatal("The table should have 4 mounts but has", len(table))
+	}
+
+	expected := Mount{Point: "/mnt/my share", FsType: "nfs4", Source: "server:/export", Options: []string{"rw", "nosuid", "rw", "vers=4.2"}, Dev: 45}
+	if !reflect.DeepEqual(table[2], expected) {
+		t.Fatal("The mount should be", expected, "but is", table[2])
+	}
+	if table[1].Dev != 8<<8|1 {
+		t.Fatal("The device of /dev/sda1 should be", 8<<8|1, "but is", table[1].Dev)
+	}
+
+	if m := table.At("/mnt/my share"); m == nil || m.FsType != "xfs" {
+		t.Fatal("The last mount at /mnt/my share should be the xfs one but is", m)
+	}
+	if m := table.At("/mnt"); m != nil {
+		t.Fatal("Nothing should be mounted at /mnt but", m, "is")
+	}
+	if m := table.Find("/mnt/my share/a/b"); m == nil || m.FsType != "xfs" {
+		t.Fatal("/mnt/my share/a/b should be in the xfs mount but is in", m)
+	}
+	if m := table.Find("/home/jeff"); m == nil || m.FsType != "ext4" {
+		t.Fatal("/home/jeff should be in the root mount but is in", m)
+	}
+}
+
+func TestReadMountTable(t *testing.T) {
+	table, err := ReadMountTable(MountInfoFile)
+	if os.IsNotExist(err) {
+		t.Skip(MountInfoFile, "doesn't exist")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := table.Find("/")
+	if m == nil {
+		t.Fatal("The root should be mounted")
+	}
+	dev, err := GetFsDevId("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overlay and btrfs filesystems report other devices than their mounts.
+	if m.FsType != "overlay" && m.FsType != "btrfs" && m.Dev != dev {
+		t.Fatal("The device of the root mount should be", dev, "but is", m.Dev)
+	}
+}
@@ -0,0 +1,55 @@
+package spacehoarder
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The files that name the users and groups.
+const (
+	PasswdFile = "/etc/passwd"
+	GroupFile  = "/etc/group"
+)
+
+// ReadIdNames reads a file in the format of /etc/passwd or /etc/group, and returns the names of
+// the ids in it. Lines that are malformed are skipped, and the first name of an id is kept.
+func ReadIdNames(path string) (map[uint32]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[uint32]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// name:password:id:...
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[uint32(id)]; !ok {
+			names[uint32(id)] = fields[0]
+		}
+	}
+	return names, s.Err()
+}
+
+// IdName returns the name of id in names, or the id itself if it has no name.
+func IdName(names map[uint32]string, id uint32) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
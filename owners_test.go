@@ -0,0 +1,44 @@
+package spacehoarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadIdNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sphowners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+	data := "root:x:0:0:root:/root:/bin/bash\n" +
+		"# comment\n" +
+		"\n" +
+		"jeff:x:1000:1000:Jeff,,,:/home/jeff:/bin/bash\n" +
+		"broken:x:notanumber:0::/:/bin/false\n" +
+		"alias:x:1000:1000::/:/bin/false\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ReadIdNames(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint32]string{0: "root", 1000: "jeff"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatal("Names should be", expected, "but are", names)
+	}
+
+	if s := IdName(names, 1000); s != "jeff" {
+		t.Fatal("Name wrong: ", s)
+	}
+	if s := IdName(names, 42); s != "42" {
+		t.Fatal("Name wrong: ", s)
+	}
+}
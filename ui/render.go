@@ -4,7 +4,6 @@
 package ui
 
 import (
-	sh "github.com/jeffwilliams/spacehoarder"
 	"github.com/jeffwilliams/spacehoarder/dirtree"
 	"github.com/jeffwilliams/squarify"
 	"github.com/mattn/go-gtk/gdk"
@@ -109,8 +108,8 @@ func Render(template *gdk.Drawable, width, height int, blocks []squarify.Block,
 
 		// Draw title
 		if block.TreeSizer != nil {
-			dir := &block.TreeSizer.(*dirtree.Node).Info
-			style.TitleLayout.SetText(dir.Basename + " (" + sh.FancySize(dir.Size) + ")")
+			node := block.TreeSizer.(*dirtree.Node)
+			style.TitleLayout.SetText(node.Info.Basename + " (" + node.Info.FormatSize(node.SizeMode) + ")")
 			style.TitleLayout.SetWidth(w * pango.SCALE)
 			pixmap.GetDrawable().DrawLayout(gc, x+1, y+1, style.TitleLayout)
 		} else {
@@ -17,3 +17,14 @@ func FancySize(size int64) string {
 
 	return fmt.Sprintf("%.1f%sB", f, units[i])
 }
+
+// FancySizeDelta formats a change in size like FancySize, with a sign.
+func FancySizeDelta(delta int64) string {
+	switch {
+	case delta > 0:
+		return "+" + FancySize(delta)
+	case delta < 0:
+		return "-" + FancySize(-delta)
+	}
+	return FancySize(0)
+}
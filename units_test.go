@@ -19,3 +19,19 @@ func TestFancySize(t *testing.T) {
 	}
 
 }
+
+func TestFancySizeDelta(t *testing.T) {
+
+	if s := FancySizeDelta(1024); s != "+1.0KB" {
+		t.Fatal("Format wrong: ", s)
+	}
+
+	if s := FancySizeDelta(-125); s != "-125.0B" {
+		t.Fatal("Format wrong: ", s)
+	}
+
+	if s := FancySizeDelta(0); s != "0.0B" {
+		t.Fatal("Format wrong: ", s)
+	}
+
+}